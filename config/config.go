@@ -9,6 +9,8 @@ package config
 
 import (
 	"os"
+	"regexp"
+	"strings"
 
 	"github.com/imdario/mergo"
 	"github.com/pelletier/go-toml"
@@ -18,6 +20,7 @@ import (
 	"github.com/containerd/nydus-snapshotter/internal/flags"
 	"github.com/containerd/nydus-snapshotter/pkg/cgroup"
 	"github.com/containerd/nydus-snapshotter/pkg/errdefs"
+	"github.com/containerd/nydus-snapshotter/pkg/layout"
 	"github.com/containerd/nydus-snapshotter/pkg/utils/file"
 	"github.com/containerd/nydus-snapshotter/pkg/utils/parser"
 	"github.com/containerd/nydus-snapshotter/pkg/utils/sysinfo"
@@ -143,11 +146,125 @@ type ImageConfig struct {
 	ValidateSignature bool   `toml:"validate_signature"`
 }
 
+// Where to place the `extraoption` among nydus-overlayfs mount options
+const (
+	ExtraOptionPlacementFirst string = "first"
+	ExtraOptionPlacementLast  string = "last"
+)
+
+// JSON fields of `ExtraOption` which can be selected for emitting
+var ExtraOptionFieldNames = []string{"source", "config", "snapshotdir", "fs_version", "schema_version",
+	"backend_type", "mirror_count", "primary_mirror", "mount_retries"}
+
+// Whether the field is one of `ExtraOptionFieldNames`.
+func IsExtraOptionField(field string) bool {
+	for _, f := range ExtraOptionFieldNames {
+		if f == field {
+			return true
+		}
+	}
+	return false
+}
+
+// How `ExtraOption` is serialized into nydus-overlayfs mount options
+const (
+	// Base64 encoded json, the default and what nydus-overlayfs consumes.
+	ExtraOptionFormatBase64JSON string = "base64-json"
+	// Plain json as `extraoption_json`, only for consumers reading the mount slice directly
+	// since it contains commas. nydus-overlayfs doesn't strip it.
+	ExtraOptionFormatRawJSON string = "raw-json"
+	// Gzip compressed and base64 encoded json as `extraoption_gz`, keeps large daemon
+	// configurations short. Needs a nydus-overlayfs stripping `extraoption_gz`.
+	ExtraOptionFormatBase64GzipJSON string = "base64-gzip-json"
+)
+
+const DefaultFuseSubtype = "nydus-overlayfs"
+
+var fuseSubtypeRegexp = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9._-]*$`)
+
+// Overlay flags allowed to be configured, which affect how overlayfs handles hardlinks
+// and renames for some images
+var allowedOverlayFlags = map[string]bool{
+	"metacopy=on":           true,
+	"metacopy=off":          true,
+	"redirect_dir=on":       true,
+	"redirect_dir=off":      true,
+	"redirect_dir=follow":   true,
+	"redirect_dir=nofollow": true,
+}
+
+// How to handle a cache directory in daemon configuration which is not writable
+const (
+	CacheDirCheckWarn  string = "warn"
+	CacheDirCheckError string = "error"
+	// Create a missing cache directory, fail the mount on any other problem
+	CacheDirCheckCreate string = "create"
+)
+
 // Configure containerd snapshots interfaces and how to process the snapshots
 // requests from containerd
 type SnapshotConfig struct {
 	EnableNydusOverlayFS bool `toml:"enable_nydus_overlayfs"`
 	SyncRemove           bool `toml:"sync_remove"`
+	// Return a plain overlay mount rather than failing for nydus snapshots without bootstrap
+	AllowEmptyBootstrap bool `toml:"allow_empty_bootstrap"`
+	// "first" or "last", defaults to "last"
+	ExtraOptionPlacement string `toml:"extra_option_placement"`
+	// Max bytes of daemon configuration embedded in `extraoption`, 0 means the default 1MB.
+	// Not applied when the configuration is referred to by file.
+	MaxExtraOptionConfigSize int `toml:"max_extra_option_config_size"`
+	// Expose non-secret backend summary, e.g. mirrors count, in `extraoption` for debugging
+	ExposeBackendSummary bool `toml:"expose_backend_summary"`
+	// Check the bootstrap lives in the snapshots directory tree
+	ValidateBootstrapPath bool `toml:"validate_bootstrap_path"`
+	// Check the snapshot directory has the overlay upper and work directories before mounting
+	ValidateSnapshotLayout bool `toml:"validate_snapshot_layout"`
+	// Daemons serving the same blobs to fall back to when the primary daemon is unavailable
+	FallbackDaemonIDs []string `toml:"fallback_daemon_ids"`
+	// "base64-json", "base64-gzip-json" or "raw-json", defaults to "base64-json"
+	ExtraOptionFormat string `toml:"extra_option_format"`
+	// Warn on instance configuration older than the shared daemon. Never rejected, as a
+	// restarted or failed over daemon re-attaches configurations which predate it.
+	WarnStaleConfig bool `toml:"warn_stale_config"`
+	// Emit sha256 of the `extraoption` payload as sibling option `extraoption_checksum`.
+	// Needs a nydus-overlayfs stripping it, which only strips `extraoption` by now.
+	EmitExtraOptionChecksum bool `toml:"emit_extra_option_checksum"`
+	// Emit the filesystem version as sibling option `fs_version` in plain text.
+	// Needs a nydus-overlayfs stripping it, which only strips `extraoption` by now.
+	EmitFsVersionOption bool `toml:"emit_fs_version_option"`
+	// Write the daemon configuration to a file in the snapshot directory and refer to it
+	// in `extraoption` as "@file:<path>" rather than embedding the content
+	ExtraOptionConfigFile bool `toml:"extra_option_config_file"`
+	// `extraoption` fields to emit per fs driver, all fields if not set.
+	// "source", "config", "snapshotdir", "fs_version" and "schema_version" are always emitted.
+	ExtraOptionFields map[string][]string `toml:"extra_option_fields"`
+	// Check in background whether the storage backend is reachable and warn if not
+	CheckBackendReachability bool `toml:"check_backend_reachability"`
+	// FUSE subtype of nydus-overlayfs mounts, e.g. "nydus-overlayfs" for type "fuse.nydus-overlayfs"
+	FuseSubtype string `toml:"fuse_subtype"`
+	// Max bytes of a single overlay mount option, e.g. `lowerdir`, 0 means no limit
+	MaxMountOptionLength int `toml:"max_mount_option_length"`
+	// Check the nydus-overlayfs mount helper is installed at startup, warn if not
+	CheckOverlayFsHelper bool `toml:"check_overlayfs_helper"`
+	// "warn" or "error" on a missing or unwritable cache directory in daemon configuration,
+	// or "create" to create a missing one. Empty to disable
+	CacheDirCheck string `toml:"cache_dir_check"`
+	// Extra overlay flags merged into nydus-overlayfs mount options, e.g. "metacopy=on"
+	OverlayFlags []string `toml:"overlay_flags"`
+	// Require every parent layer of a nydus snapshot to have a bootstrap
+	StrictParentBootstraps bool `toml:"strict_parent_bootstraps"`
+	// Filesystem version assumed if it can't be detected from bootstrap, e.g. "v6", empty to fail the mount
+	FallbackFsVersion string `toml:"fallback_fs_version"`
+	// Warn if the daemon configuration version is not supported by the running nydusd
+	CheckConfigVersion bool `toml:"check_config_version"`
+	// Backend hosts, optionally with port, mounts may refer to. Empty to allow all.
+	AllowedBackends []string `toml:"allowed_backends"`
+	// Deadline of reading the bootstrap when building a mount, 0 means the default 10 seconds
+	BootstrapReadTimeoutSecs int64 `toml:"bootstrap_read_timeout_secs"`
+	// Frame base64 encoded `extraoption` with a magic, length and crc32 header
+	EmitExtraOptionHeader bool `toml:"emit_extra_option_header"`
+	// Hint of how many times the guest agent retries a failed mount, 0 to not retry
+	MountRetries int `toml:"mount_retries"`
 }
 
 // Configure cache manager that manages the cache files lifecycle
@@ -272,6 +389,74 @@ func ValidateConfig(c *SnapshotterConfig) error {
 		return errors.Errorf("nydusd worker thread number %d is too big, max 1024", c.DaemonConfig.ThreadsNumber)
 	}
 
+	switch c.SnapshotsConfig.ExtraOptionPlacement {
+	case "", ExtraOptionPlacementFirst, ExtraOptionPlacementLast:
+	default:
+		return errors.Errorf("invalid extra option placement %q", c.SnapshotsConfig.ExtraOptionPlacement)
+	}
+
+	switch c.SnapshotsConfig.ExtraOptionFormat {
+	case "", ExtraOptionFormatBase64JSON, ExtraOptionFormatBase64GzipJSON, ExtraOptionFormatRawJSON:
+	default:
+		return errors.Errorf("invalid extra option format %q", c.SnapshotsConfig.ExtraOptionFormat)
+	}
+	if c.SnapshotsConfig.EmitExtraOptionHeader && c.SnapshotsConfig.ExtraOptionFormat == ExtraOptionFormatRawJSON {
+		return errors.Errorf("extra option header is not supported by format %q", ExtraOptionFormatRawJSON)
+	}
+
+	for fsDriver, fields := range c.SnapshotsConfig.ExtraOptionFields {
+		if fsDriver != FsDriverFscache && fsDriver != FsDriverFusedev {
+			return errors.Errorf("invalid filesystem driver %q in extra option fields", fsDriver)
+		}
+		for _, field := range fields {
+			if !IsExtraOptionField(field) {
+				return errors.Errorf("unknown extra option field %q for filesystem driver %s", field, fsDriver)
+			}
+		}
+	}
+
+	switch c.SnapshotsConfig.CacheDirCheck {
+	case "", CacheDirCheckWarn, CacheDirCheckError, CacheDirCheckCreate:
+	default:
+		return errors.Errorf("invalid cache dir check %q", c.SnapshotsConfig.CacheDirCheck)
+	}
+
+	for _, flag := range c.SnapshotsConfig.OverlayFlags {
+		if !allowedOverlayFlags[flag] {
+			return errors.Errorf("invalid overlay flag %q", flag)
+		}
+	}
+
+	if c.SnapshotsConfig.FallbackFsVersion != "" && !layout.IsKnownFsVersion(c.SnapshotsConfig.FallbackFsVersion) {
+		return errors.Errorf("invalid fallback fs version %q", c.SnapshotsConfig.FallbackFsVersion)
+	}
+
+	for _, backend := range c.SnapshotsConfig.AllowedBackends {
+		if backend == "" || strings.ContainsAny(backend, "/@") {
+			return errors.Errorf("invalid allowed backend %q, expect host or host:port", backend)
+		}
+	}
+
+	if c.SnapshotsConfig.FuseSubtype != "" && !fuseSubtypeRegexp.MatchString(c.SnapshotsConfig.FuseSubtype) {
+		return errors.Errorf("invalid fuse subtype %q", c.SnapshotsConfig.FuseSubtype)
+	}
+
+	if c.SnapshotsConfig.BootstrapReadTimeoutSecs < 0 {
+		return errors.Errorf("invalid bootstrap read timeout %d", c.SnapshotsConfig.BootstrapReadTimeoutSecs)
+	}
+
+	if c.SnapshotsConfig.MountRetries < 0 {
+		return errors.Errorf("invalid mount retries %d", c.SnapshotsConfig.MountRetries)
+	}
+
+	if c.SnapshotsConfig.MaxMountOptionLength < 0 {
+		return errors.Errorf("invalid max mount option length %d", c.SnapshotsConfig.MaxMountOptionLength)
+	}
+
+	if c.SnapshotsConfig.MaxExtraOptionConfigSize < 0 {
+		return errors.Errorf("invalid max extra option config size %d", c.SnapshotsConfig.MaxExtraOptionConfigSize)
+	}
+
 	if c.RemoteConfig.AuthConfig.EnableCRIKeychain && c.RemoteConfig.AuthConfig.EnableKubeconfigKeychain {
 		return errors.Wrapf(errdefs.ErrInvalidArgument,
 			"\"enable_cri_keychain\" and \"enable_kubeconfig_keychain\" can't be set at the same time")
@@ -51,6 +51,9 @@ func TestLoadSnapshotterTOMLConfig(t *testing.T) {
 		SnapshotsConfig: SnapshotConfig{
 			EnableNydusOverlayFS: false,
 			SyncRemove:           false,
+			ExtraOptionPlacement: "last",
+			ExtraOptionFormat:    "base64-json",
+			FuseSubtype:          "nydus-overlayfs",
 		},
 		RemoteConfig: RemoteConfig{
 			ConvertVpcRegistry: false,
@@ -252,3 +255,56 @@ func TestProcessConfigurations(t *testing.T) {
 	err = ProcessConfigurations(&snapshotterConfig3)
 	A.NoError(err)
 }
+
+func TestValidateOverlayFlags(t *testing.T) {
+	A := assert.New(t)
+	var cfg SnapshotterConfig
+	A.NoError(cfg.FillUpWithDefaults())
+
+	cfg.SnapshotsConfig.OverlayFlags = []string{"metacopy=on", "redirect_dir=on"}
+	A.NoError(ValidateConfig(&cfg))
+
+	cfg.SnapshotsConfig.OverlayFlags = []string{"metacopy=on", "userxattr"}
+	A.Error(ValidateConfig(&cfg))
+}
+
+func TestValidateAllowedBackends(t *testing.T) {
+	A := assert.New(t)
+	var cfg SnapshotterConfig
+	A.NoError(cfg.FillUpWithDefaults())
+
+	cfg.SnapshotsConfig.AllowedBackends = []string{"registry.local", "registry.local:5000"}
+	A.NoError(ValidateConfig(&cfg))
+
+	for _, backend := range []string{"", "https://registry.local", "user@registry.local"} {
+		cfg.SnapshotsConfig.AllowedBackends = []string{backend}
+		A.Error(ValidateConfig(&cfg))
+	}
+}
+
+func TestValidateMountRetries(t *testing.T) {
+	A := assert.New(t)
+	var cfg SnapshotterConfig
+	A.NoError(cfg.FillUpWithDefaults())
+
+	cfg.SnapshotsConfig.MountRetries = 3
+	A.NoError(ValidateConfig(&cfg))
+
+	cfg.SnapshotsConfig.MountRetries = -1
+	A.Error(ValidateConfig(&cfg))
+}
+
+func TestValidateExtraOptionFields(t *testing.T) {
+	A := assert.New(t)
+	var cfg SnapshotterConfig
+	A.NoError(cfg.FillUpWithDefaults())
+
+	cfg.SnapshotsConfig.ExtraOptionFields = map[string][]string{FsDriverFusedev: {"source", "config", "mount_retries"}}
+	A.NoError(ValidateConfig(&cfg))
+
+	cfg.SnapshotsConfig.ExtraOptionFields = map[string][]string{FsDriverFusedev: {"source", "snapshot_dir"}}
+	A.ErrorContains(ValidateConfig(&cfg), `unknown extra option field "snapshot_dir"`)
+
+	cfg.SnapshotsConfig.ExtraOptionFields = map[string][]string{"blockdev": {"source"}}
+	A.Error(ValidateConfig(&cfg))
+}
@@ -9,12 +9,13 @@ package daemonconfig
 
 import (
 	"encoding/json"
-	"os"
+	"strings"
 
 	"github.com/pkg/errors"
 
 	"github.com/containerd/nydus-snapshotter/config"
 	"github.com/containerd/nydus-snapshotter/pkg/auth"
+	"github.com/containerd/nydus-snapshotter/pkg/utils/file"
 	"github.com/containerd/nydus-snapshotter/pkg/utils/registry"
 )
 
@@ -34,6 +35,8 @@ type DaemonConfig interface {
 	StorageBackend() (StorageBackendType, *BackendConfig)
 	UpdateMirrors(mirrorsConfigDir, registryHost string) error
 	DumpString() (string, error)
+	// Dump with credentials masked, for logging
+	DumpStringRedacted() (string, error)
 	DumpFile(path string) error
 }
 
@@ -57,6 +60,44 @@ func NewDaemonConfig(fsDriver, path string) (DaemonConfig, error) {
 	}
 }
 
+// Daemon configurations factory working on the json content rather than a file,
+// e.g. the configuration embedded in a mount option.
+func ParseDaemonConfig(fsDriver string, content []byte) (DaemonConfig, error) {
+	switch fsDriver {
+	case config.FsDriverFscache:
+		cfg, err := ParseFscacheConfig(content)
+		if err != nil {
+			return nil, err
+		}
+		return cfg, nil
+	case config.FsDriverFusedev:
+		cfg, err := ParseFuseConfig(content)
+		if err != nil {
+			return nil, err
+		}
+		return cfg, nil
+	default:
+		return nil, errors.Errorf("unsupported, fs driver %q", fsDriver)
+	}
+}
+
+// Tell which fs driver a daemon configuration content is written for, by its top level layout.
+func DetectFsDriver(content []byte) (string, error) {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(content, &fields); err != nil {
+		return "", errors.Wrapf(err, "unmarshal")
+	}
+
+	if _, ok := fields["device"]; ok {
+		return config.FsDriverFusedev, nil
+	}
+	if _, ok := fields["config"]; ok {
+		return config.FsDriverFscache, nil
+	}
+
+	return "", errors.New("unknown daemon configuration layout")
+}
+
 type MirrorConfig struct {
 	Host                string            `json:"host,omitempty"`
 	Headers             map[string]string `json:"headers,omitempty"`
@@ -124,13 +165,68 @@ type DeviceConfig struct {
 // For nydusd as FUSE daemon. Serialize Daemon info and persist to a json file
 // We don't have to persist configuration file for fscache since its configuration
 // is passed through HTTP API.
+// The file is replaced atomically since mount requests may read it concurrently.
 func DumpConfigFile(c interface{}, path string) error {
 	b, err := json.Marshal(c)
 	if err != nil {
 		return errors.Wrapf(err, "marshal config")
 	}
 
-	return os.WriteFile(path, b, 0600)
+	return file.WriteFileAtomic(path, b, 0600)
+}
+
+// Placeholder of credentials in redacted configurations
+const RedactedPlaceholder = "<redacted>"
+
+// Mask credentials of the backend configuration, including those embedded in
+// endpoints as `user:password@`. Mirrors are copied rather than modified in
+// place since they are shared with the original.
+func redactBackendConfig(b *BackendConfig) {
+	for _, secret := range []*string{&b.Auth, &b.RegistryToken, &b.AccessKeyID, &b.AccessKeySecret} {
+		if *secret != "" {
+			*secret = RedactedPlaceholder
+		}
+	}
+	for _, endpoint := range []*string{&b.Host, &b.BlobRedirectedHost, &b.Proxy.URL} {
+		*endpoint = redactUserinfo(*endpoint)
+	}
+
+	if len(b.Mirrors) == 0 {
+		return
+	}
+	mirrors := make([]MirrorConfig, len(b.Mirrors))
+	for i, m := range b.Mirrors {
+		if len(m.Headers) > 0 {
+			headers := make(map[string]string, len(m.Headers))
+			for k, v := range m.Headers {
+				if strings.EqualFold(k, "Authorization") {
+					v = RedactedPlaceholder
+				}
+				headers[k] = v
+			}
+			m.Headers = headers
+		}
+		m.Host = redactUserinfo(m.Host)
+		mirrors[i] = m
+	}
+	b.Mirrors = mirrors
+}
+
+// Mask the `user:password@` part of an endpoint, with or without URL scheme.
+func redactUserinfo(endpoint string) string {
+	start := 0
+	if i := strings.Index(endpoint, "://"); i >= 0 {
+		start = i + 3
+	}
+	authority := endpoint[start:]
+	if i := strings.IndexAny(authority, "/?#"); i >= 0 {
+		authority = authority[:i]
+	}
+	at := strings.LastIndex(authority, "@")
+	if at < 0 {
+		return endpoint
+	}
+	return endpoint[:start] + RedactedPlaceholder + endpoint[start+at:]
 }
 
 func DumpConfigString(c interface{}) (string, error) {
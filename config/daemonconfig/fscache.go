@@ -52,12 +52,22 @@ type FscacheDaemonConfig struct {
 
 // Load Fscache configuration template file
 func LoadFscacheConfig(p string) (*FscacheDaemonConfig, error) {
-	var cfg FscacheDaemonConfig
 	b, err := os.ReadFile(p)
 	if err != nil {
 		return nil, errors.Wrapf(err, "read fscache configuration file %s", p)
 	}
-	if err = json.Unmarshal(b, &cfg); err != nil {
+	cfg, err := ParseFscacheConfig(b)
+	if err != nil {
+		return nil, errors.Wrapf(err, "load fscache configuration file %s", p)
+	}
+
+	return cfg, nil
+}
+
+// Parse fscache configuration from its json content
+func ParseFscacheConfig(b []byte) (*FscacheDaemonConfig, error) {
+	var cfg FscacheDaemonConfig
+	if err := json.Unmarshal(b, &cfg); err != nil {
 		return nil, errors.Wrapf(err, "unmarshal")
 	}
 
@@ -122,6 +132,16 @@ func (c *FscacheDaemonConfig) DumpString() (string, error) {
 	return DumpConfigString(c)
 }
 
+func (c *FscacheDaemonConfig) DumpStringRedacted() (string, error) {
+	redacted := *c
+	if c.Config != nil {
+		cfg := *c.Config
+		redactBackendConfig(&cfg.BackendConfig)
+		redacted.Config = &cfg
+	}
+	return DumpConfigString(&redacted)
+}
+
 func (c *FscacheDaemonConfig) DumpFile(f string) error {
 	if err := os.MkdirAll(path.Dir(f), 0755); err != nil {
 		return err
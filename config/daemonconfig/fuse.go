@@ -47,9 +47,19 @@ func LoadFuseConfig(p string) (*FuseDaemonConfig, error) {
 	if err != nil {
 		return nil, errors.Wrapf(err, "read FUSE configuration file %s", p)
 	}
+	cfg, err := ParseFuseConfig(b)
+	if err != nil {
+		return nil, errors.Wrapf(err, "load FUSE configuration file %s", p)
+	}
+
+	return cfg, nil
+}
+
+// Parse fuse daemon configuration from its json content
+func ParseFuseConfig(b []byte) (*FuseDaemonConfig, error) {
 	var cfg FuseDaemonConfig
 	if err := json.Unmarshal(b, &cfg); err != nil {
-		return nil, errors.Wrapf(err, "unmarshal %s", p)
+		return nil, errors.Wrapf(err, "unmarshal")
 	}
 
 	if cfg.Device == nil {
@@ -94,6 +104,16 @@ func (c *FuseDaemonConfig) DumpString() (string, error) {
 	return DumpConfigString(c)
 }
 
+func (c *FuseDaemonConfig) DumpStringRedacted() (string, error) {
+	redacted := *c
+	if c.Device != nil {
+		device := *c.Device
+		redactBackendConfig(&device.Backend.Config)
+		redacted.Device = &device
+	}
+	return DumpConfigString(&redacted)
+}
+
 func (c *FuseDaemonConfig) DumpFile(f string) error {
 	if err := os.MkdirAll(path.Dir(f), 0755); err != nil {
 		return err
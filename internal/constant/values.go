@@ -49,4 +49,10 @@ const (
 	DefaultRotateLogMaxAge     = 0 // days
 	DefaultRotateLogLocalTime  = true
 	DefaultRotateLogCompress   = true
+
+	// Max size of the daemon configuration embedded in `extraoption`
+	DefaultMaxExtraOptionConfigSize = 1 << 20 // 1 megabytes
+
+	// Deadline of reading the bootstrap when building a mount
+	DefaultBootstrapReadTimeoutSecs = 10
 )
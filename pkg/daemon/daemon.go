@@ -174,6 +174,14 @@ func (d *Daemon) GetState() (types.DaemonState, error) {
 	return st, nil
 }
 
+// Return the cached nydusd build information, which is empty until the state
+// is queried from nydusd.
+func (d *Daemon) DaemonVersion() types.BuildTimeInfo {
+	d.Lock()
+	defer d.Unlock()
+	return d.Version
+}
+
 // Return the cached nydusd working status, no API is invoked.
 func (d *Daemon) State() types.DaemonState {
 	d.Lock()
@@ -9,6 +9,9 @@ package layout
 import (
 	"encoding/binary"
 	"errors"
+	"fmt"
+	"io"
+	"os"
 	"unsafe"
 )
 
@@ -30,6 +33,9 @@ const (
 	DummyMountpoint        string = "/dummy"
 )
 
+// Returned when the bootstrap header matches no known filesystem version
+var ErrUnknownFsVersion = errors.New("unknown file system header")
+
 var nativeEndian binary.ByteOrder
 
 type ImageMode int
@@ -59,7 +65,8 @@ func isRafsV6(buf []byte) bool {
 
 func DetectFsVersion(header []byte) (string, error) {
 	if len(header) < 8 {
-		return "", errors.New("header buffer to DetectFsVersion is too small")
+		// A truncated bootstrap has no recognizable header either
+		return "", fmt.Errorf("header buffer to DetectFsVersion is too small: %w", ErrUnknownFsVersion)
 	}
 	magic := binary.LittleEndian.Uint32(header[0:4])
 	fsVersion := binary.LittleEndian.Uint32(header[4:8])
@@ -72,5 +79,34 @@ func DetectFsVersion(header []byte) (string, error) {
 		return RafsV6, nil
 	}
 
-	return "", errors.New("unknown file system header")
+	if v, ok := detectRegisteredFsVersion(header); ok {
+		return v, nil
+	}
+
+	return "", ErrUnknownFsVersion
+}
+
+// Detect the filesystem version of a bootstrap file.
+func DetectFsVersionFromFile(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", fmt.Errorf("open bootstrap: %w", err)
+	}
+	defer f.Close()
+
+	return DetectFsVersionFromReader(f)
+}
+
+// Detect the filesystem version from the beginning of a bootstrap. A single read
+// may return fewer bytes than available, so read until the header is full or EOF.
+// Bootstraps smaller than MaxSuperBlockSize, e.g. RAFS v5 ones with only the
+// superblock, are accepted.
+func DetectFsVersionFromReader(r io.Reader) (string, error) {
+	header := make([]byte, MaxSuperBlockSize)
+	sz, err := io.ReadFull(r, header)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return "", fmt.Errorf("read bootstrap: %w", err)
+	}
+
+	return DetectFsVersion(header[:sz])
 }
@@ -0,0 +1,70 @@
+/*
+ * Copyright (c) 2023. Nydus Developers. All rights reserved.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package layout
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"testing/iotest"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDetectFsVersionFromFile(t *testing.T) {
+	dir := t.TempDir()
+
+	v5 := make([]byte, 8)
+	binary.LittleEndian.PutUint32(v5[0:4], RafsV5SuperMagic)
+	binary.LittleEndian.PutUint32(v5[4:8], RafsV5SuperVersion)
+	v5Path := filepath.Join(dir, "v5.boot")
+	require.NoError(t, os.WriteFile(v5Path, v5, 0644))
+
+	v6 := make([]byte, RafsV6SuperBlockSize+4096)
+	nativeEndian.PutUint32(v6[RafsV6SuperBlockOffset:], RafsV6SuperMagic)
+	v6Path := filepath.Join(dir, "v6.boot")
+	require.NoError(t, os.WriteFile(v6Path, v6, 0644))
+
+	version, err := DetectFsVersionFromFile(v5Path)
+	require.NoError(t, err)
+	require.Equal(t, RafsV5, version)
+
+	version, err = DetectFsVersionFromFile(v6Path)
+	require.NoError(t, err)
+	require.Equal(t, RafsV6, version)
+
+	unknown := filepath.Join(dir, "unknown.boot")
+	require.NoError(t, os.WriteFile(unknown, make([]byte, MaxSuperBlockSize), 0644))
+	_, err = DetectFsVersionFromFile(unknown)
+	require.ErrorIs(t, err, ErrUnknownFsVersion)
+
+	empty := filepath.Join(dir, "empty.boot")
+	require.NoError(t, os.WriteFile(empty, nil, 0644))
+	_, err = DetectFsVersionFromFile(empty)
+	require.Error(t, err)
+
+	_, err = DetectFsVersionFromFile(filepath.Join(dir, "missing.boot"))
+	require.ErrorIs(t, err, os.ErrNotExist)
+}
+
+func TestDetectFsVersionFromShortReads(t *testing.T) {
+	v6 := make([]byte, RafsV6SuperBlockSize)
+	nativeEndian.PutUint32(v6[RafsV6SuperBlockOffset:], RafsV6SuperMagic)
+	version, err := DetectFsVersionFromReader(iotest.OneByteReader(bytes.NewReader(v6)))
+	require.NoError(t, err)
+	require.Equal(t, RafsV6, version)
+
+	_, err = DetectFsVersionFromReader(iotest.OneByteReader(bytes.NewReader(v6[:4])))
+	require.ErrorContains(t, err, "too small")
+	require.ErrorIs(t, err, ErrUnknownFsVersion)
+
+	_, err = DetectFsVersionFromReader(iotest.ErrReader(io.ErrClosedPipe))
+	require.ErrorIs(t, err, io.ErrClosedPipe)
+}
@@ -0,0 +1,74 @@
+/*
+ * Copyright (c) 2023. Nydus Developers. All rights reserved.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package layout
+
+import (
+	"sort"
+	"sync"
+)
+
+// Detect a filesystem version from the bootstrap header, reporting false
+// if the header is not recognized.
+type FsVersionDetector func(header []byte) (string, bool)
+
+// Registries may be updated by plugins at init time and read concurrently
+// from the mount path, so all accesses are guarded by the lock.
+var registry = struct {
+	sync.RWMutex
+	versions  map[string]struct{}
+	detectors []FsVersionDetector
+}{
+	versions: map[string]struct{}{RafsV5: {}, RafsV6: {}},
+}
+
+// Register a filesystem version as known to the snapshotter.
+func RegisterFsVersion(version string) {
+	registry.Lock()
+	defer registry.Unlock()
+	registry.versions[version] = struct{}{}
+}
+
+func IsKnownFsVersion(version string) bool {
+	registry.RLock()
+	defer registry.RUnlock()
+	_, ok := registry.versions[version]
+	return ok
+}
+
+// Return a sorted snapshot of the known filesystem versions.
+func KnownFsVersions() []string {
+	registry.RLock()
+	versions := make([]string, 0, len(registry.versions))
+	for v := range registry.versions {
+		versions = append(versions, v)
+	}
+	registry.RUnlock()
+
+	sort.Strings(versions)
+	return versions
+}
+
+// Register an additional detector consulted after the built-in RAFS ones.
+func RegisterFsVersionDetector(d FsVersionDetector) {
+	registry.Lock()
+	defer registry.Unlock()
+	registry.detectors = append(registry.detectors, d)
+}
+
+func detectRegisteredFsVersion(header []byte) (string, bool) {
+	registry.RLock()
+	detectors := registry.detectors
+	registry.RUnlock()
+
+	for _, d := range detectors {
+		if v, ok := d(header); ok {
+			return v, true
+		}
+	}
+
+	return "", false
+}
@@ -0,0 +1,52 @@
+/*
+ * Copyright (c) 2023. Nydus Developers. All rights reserved.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package layout
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestFsVersionRegistryConcurrent(t *testing.T) {
+	require.True(t, IsKnownFsVersion(RafsV5))
+	require.True(t, IsKnownFsVersion(RafsV6))
+	require.False(t, IsKnownFsVersion("v7-test"))
+
+	header := make([]byte, 8)
+	var wg sync.WaitGroup
+	for i := 0; i < 16; i++ {
+		wg.Add(2)
+		go func(i int) {
+			defer wg.Done()
+			RegisterFsVersion(fmt.Sprintf("test-%d", i))
+			RegisterFsVersionDetector(func([]byte) (string, bool) { return "", false })
+		}(i)
+		go func() {
+			defer wg.Done()
+			_ = IsKnownFsVersion(RafsV6)
+			_ = KnownFsVersions()
+			_, _ = DetectFsVersion(header)
+		}()
+	}
+	wg.Wait()
+
+	for i := 0; i < 16; i++ {
+		require.True(t, IsKnownFsVersion(fmt.Sprintf("test-%d", i)))
+	}
+	require.Contains(t, KnownFsVersions(), RafsV5)
+
+	RegisterFsVersionDetector(func(h []byte) (string, bool) {
+		return "v7-test", h[0] == 0x7
+	})
+	header[0] = 0x7
+	v, err := DetectFsVersion(header)
+	require.NoError(t, err)
+	require.Equal(t, "v7-test", v)
+}
@@ -0,0 +1,83 @@
+/*
+ * Copyright (c) 2023. Nydus Developers. All rights reserved.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package collector
+
+import (
+	"sync"
+
+	"github.com/containerd/nydus-snapshotter/pkg/layout"
+	"github.com/containerd/nydus-snapshotter/pkg/metrics/data"
+)
+
+// Label value replacing any value not allowed by a sanitizer
+const OtherLabelValue = "other"
+
+// Bound the values of a metric label to keep the metric cardinality low.
+type LabelSanitizer func(value string) string
+
+// Pass through the allowed values, bucket any other into OtherLabelValue.
+func AllowlistSanitizer(allowed ...string) LabelSanitizer {
+	set := make(map[string]struct{}, len(allowed))
+	for _, v := range allowed {
+		set[v] = struct{}{}
+	}
+	return func(value string) string {
+		if _, ok := set[value]; ok {
+			return value
+		}
+		return OtherLabelValue
+	}
+}
+
+// Sanitizers of labels of metrics emitted from the mount path
+var labelSanitizers = struct {
+	sync.RWMutex
+	m map[string]LabelSanitizer
+}{
+	m: map[string]LabelSanitizer{
+		data.FsVersionLabel: func(v string) string {
+			if layout.IsKnownFsVersion(v) {
+				return v
+			}
+			return OtherLabelValue
+		},
+		data.BackendTypeLabel: AllowlistSanitizer("registry", "oss", "s3", "localfs"),
+	},
+}
+
+// Replace the sanitizer of a label, e.g. to allow more values.
+func SetLabelSanitizer(label string, s LabelSanitizer) {
+	labelSanitizers.Lock()
+	defer labelSanitizers.Unlock()
+	labelSanitizers.m[label] = s
+}
+
+// Labels without a sanitizer are always bucketed, so that a new label
+// can't explode the metric by accident.
+func sanitizeLabel(label, value string) string {
+	labelSanitizers.RLock()
+	s, ok := labelSanitizers.m[label]
+	labelSanitizers.RUnlock()
+	if !ok {
+		return OtherLabelValue
+	}
+	return s(value)
+}
+
+func CollectRemoteMount(fsVersion, backendType string) {
+	data.RemoteMounts.WithLabelValues(
+		sanitizeLabel(data.FsVersionLabel, fsVersion),
+		sanitizeLabel(data.BackendTypeLabel, backendType),
+	).Inc()
+}
+
+func CollectRemoteMountOutcome(outcome, fsVersion string) {
+	data.RemoteMountOutcomes.WithLabelValues(
+		sanitizeLabel(data.MountOutcomeLabel, outcome),
+		sanitizeLabel(data.FsVersionLabel, fsVersion),
+	).Inc()
+}
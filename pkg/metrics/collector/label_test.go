@@ -0,0 +1,35 @@
+/*
+ * Copyright (c) 2023. Nydus Developers. All rights reserved.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package collector
+
+import (
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+
+	"github.com/containerd/nydus-snapshotter/pkg/layout"
+	"github.com/containerd/nydus-snapshotter/pkg/metrics/data"
+)
+
+func TestSanitizeLabel(t *testing.T) {
+	require.Equal(t, layout.RafsV6, sanitizeLabel(data.FsVersionLabel, layout.RafsV6))
+	require.Equal(t, OtherLabelValue, sanitizeLabel(data.FsVersionLabel, "v100"))
+	require.Equal(t, "registry", sanitizeLabel(data.BackendTypeLabel, "registry"))
+	require.Equal(t, OtherLabelValue, sanitizeLabel(data.BackendTypeLabel, "tenant-8f3a2c"))
+	require.Equal(t, OtherLabelValue, sanitizeLabel("tenant", "tenant-8f3a2c"))
+
+	SetLabelSanitizer("tenant", AllowlistSanitizer("gold"))
+	require.Equal(t, "gold", sanitizeLabel("tenant", "gold"))
+	require.Equal(t, OtherLabelValue, sanitizeLabel("tenant", "tenant-8f3a2c"))
+
+	CollectRemoteMount(layout.RafsV6, "registry")
+	CollectRemoteMount("v100", "tenant-8f3a2c")
+	CollectRemoteMount("v101", "tenant-9b1d7e")
+	require.Equal(t, float64(1), testutil.ToFloat64(data.RemoteMounts.WithLabelValues(layout.RafsV6, "registry")))
+	require.Equal(t, float64(2), testutil.ToFloat64(data.RemoteMounts.WithLabelValues(OtherLabelValue, OtherLabelValue)))
+}
@@ -15,6 +15,13 @@ var (
 	snapshotEventLabel     = "snapshot_operation"
 )
 
+// Labels of metrics emitted from the mount path, whose values are sanitized by the collector
+const (
+	FsVersionLabel    = "fs_version"
+	BackendTypeLabel  = "backend_type"
+	MountOutcomeLabel = "outcome"
+)
+
 var (
 	SnapshotEventElapsedHists = prometheus.NewHistogramVec(
 		prometheus.HistogramOpts{
@@ -74,6 +81,22 @@ var (
 		},
 	)
 
+	RemoteMounts = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "snapshotter_remote_mounts_total",
+			Help: "Count of nydus mounts built, by filesystem version and storage backend type.",
+		},
+		[]string{FsVersionLabel, BackendTypeLabel},
+	)
+
+	RemoteMountOutcomes = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "snapshotter_remote_mount_outcomes_total",
+			Help: "Count of attempts to build nydus mounts, by outcome, i.e. success or the failed stage, and filesystem version.",
+		},
+		[]string{MountOutcomeLabel, FsVersionLabel},
+	)
+
 	Thread = prometheus.NewGauge(
 		prometheus.GaugeOpts{
 			Name: "snapshotter_thread_counts",
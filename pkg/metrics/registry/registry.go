@@ -33,6 +33,8 @@ func init() {
 		data.Fds,
 		data.RunTime,
 		data.Thread,
+		data.RemoteMounts,
+		data.RemoteMountOutcomes,
 	)
 
 	for _, m := range data.MetricHists {
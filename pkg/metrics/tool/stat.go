@@ -11,6 +11,7 @@ import (
 	"path"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/containerd/nydus-snapshotter/pkg/errdefs"
 	"github.com/pkg/errors"
@@ -95,6 +96,17 @@ func GetProcessStat(pid int) (*Stat, error) {
 	}, nil
 }
 
+// Calculate when the process was started from its start ticks since boot.
+func GetProcessStartTime(pid int) (time.Time, error) {
+	stat, err := GetProcessStat(pid)
+	if err != nil {
+		return time.Time{}, errors.Wrapf(err, "get process stat")
+	}
+
+	elapsed := stat.Uptime - stat.Start/ClkTck
+	return time.Now().Add(-time.Duration(elapsed * float64(time.Second))), nil
+}
+
 func GetProcessRunningState(pid int) (string, error) {
 	statBytes, err := os.ReadFile(path.Join("/proc", strconv.Itoa(pid), "stat"))
 	if err != nil {
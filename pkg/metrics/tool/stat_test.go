@@ -7,7 +7,9 @@
 package tool
 
 import (
+	"os"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -19,3 +21,16 @@ func TestFindZombie(t *testing.T) {
 
 	assert.Contains(t, []string{"Ss", "S"}, s)
 }
+
+func TestGetProcessStartTime(t *testing.T) {
+	before := time.Now()
+	start, err := GetProcessStartTime(os.Getpid())
+	assert.NoError(t, err)
+
+	// Start ticks and uptime are both rounded to clock ticks.
+	assert.True(t, start.Before(before.Add(time.Second)), "start time %s is in the future", start)
+	assert.True(t, start.After(before.Add(-time.Hour)), "start time %s is too early", start)
+
+	_, err = GetProcessStartTime(-1)
+	assert.Error(t, err)
+}
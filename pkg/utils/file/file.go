@@ -6,7 +6,12 @@
 
 package file
 
-import "os"
+import (
+	"os"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+)
 
 func IsDirExisted(path string) (bool, error) {
 	s, err := os.Stat(path)
@@ -18,3 +23,31 @@ func IsDirExisted(path string) (bool, error) {
 	}
 	return s.IsDir(), nil
 }
+
+// Write data to a temporary file in the same directory and rename it to the target,
+// so that concurrent readers never observe a partially written file.
+func WriteFileAtomic(path string, data []byte, perm os.FileMode) (err error) {
+	f, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return errors.Wrapf(err, "create temporary file for %s", path)
+	}
+	defer func() {
+		if err != nil {
+			os.Remove(f.Name())
+		}
+	}()
+
+	if _, err = f.Write(data); err != nil {
+		f.Close()
+		return errors.Wrapf(err, "write temporary file %s", f.Name())
+	}
+	if err = f.Chmod(perm); err != nil {
+		f.Close()
+		return errors.Wrapf(err, "chmod temporary file %s", f.Name())
+	}
+	if err = f.Close(); err != nil {
+		return errors.Wrapf(err, "close temporary file %s", f.Name())
+	}
+
+	return os.Rename(f.Name(), path)
+}
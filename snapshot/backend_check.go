@@ -0,0 +1,196 @@
+/*
+ * Copyright (c) 2023. Nydus Developers. All rights reserved.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package snapshot
+
+import (
+	"context"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/containerd/containerd/log"
+	"github.com/pkg/errors"
+
+	"github.com/containerd/nydus-snapshotter/config/daemonconfig"
+)
+
+const backendCheckTimeout = 3 * time.Second
+
+type dialFunc func(ctx context.Context, network, address string) (net.Conn, error)
+
+var dialBackend dialFunc = (&net.Dialer{}).DialContext
+
+// Get the `host:port` address of the remote storage backend, empty if the
+// backend has no network endpoint, e.g. localfs.
+func backendAddress(c daemonconfig.DaemonConfig) string {
+	_, backend := c.StorageBackend()
+	if backend == nil {
+		return ""
+	}
+
+	endpoint := backend.Host
+	if endpoint == "" {
+		endpoint = backend.EndPoint
+	}
+	if endpoint == "" {
+		return ""
+	}
+
+	scheme := backend.Scheme
+	if strings.Contains(endpoint, "://") {
+		u, err := url.Parse(endpoint)
+		if err != nil {
+			return ""
+		}
+		scheme, endpoint = u.Scheme, u.Host
+	}
+	if _, _, err := net.SplitHostPort(endpoint); err == nil {
+		return endpoint
+	}
+	if scheme == "http" {
+		return net.JoinHostPort(endpoint, "80")
+	}
+	return net.JoinHostPort(endpoint, "443")
+}
+
+// Best-effort check whether the storage backend is reachable, only logs a warning
+// as nydusd has its own retry and mirror fallback.
+func checkBackendReachable(ctx context.Context, c daemonconfig.DaemonConfig, dial dialFunc) error {
+	addr := backendAddress(c)
+	if addr == "" {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, backendCheckTimeout)
+	defer cancel()
+	conn, err := dial(ctx, "tcp", addr)
+	if err != nil {
+		log.G(ctx).WithError(err).Warnf("storage backend %s is unreachable", addr)
+		return errors.Wrapf(err, "dial storage backend %s", addr)
+	}
+	conn.Close()
+
+	return nil
+}
+
+// A backend address is checked at most once in the interval, so that a burst of mounts
+// from the same registry doesn't dial it again and again. It outlasts the dial timeout,
+// so a check in flight is never duplicated either.
+const backendCheckInterval = 30 * time.Second
+
+// Runs background reachability checks of storage backends, deduplicated per address.
+type backendChecker struct {
+	mu      sync.Mutex
+	checked map[string]time.Time
+	dial    dialFunc
+}
+
+func newBackendChecker(dial dialFunc) *backendChecker {
+	return &backendChecker{checked: make(map[string]time.Time), dial: dial}
+}
+
+// Start checking the backend in background unless it's been checked in the interval,
+// returns whether a check is started.
+func (b *backendChecker) check(ctx context.Context, c daemonconfig.DaemonConfig) bool {
+	addr := backendAddress(c)
+	if addr == "" {
+		return false
+	}
+
+	now := time.Now()
+	b.mu.Lock()
+	if last, ok := b.checked[addr]; ok && now.Sub(last) < backendCheckInterval {
+		b.mu.Unlock()
+		return false
+	}
+	for a, last := range b.checked {
+		if now.Sub(last) >= backendCheckInterval {
+			delete(b.checked, a)
+		}
+	}
+	b.checked[addr] = now
+	b.mu.Unlock()
+
+	go func() { _ = checkBackendReachable(ctx, c, b.dial) }()
+	return true
+}
+
+// Returned when the daemon configuration refers to a backend not on the allowlist.
+var ErrBackendNotAllowed = errors.New("backend not allowed by policy")
+
+// Get the `host[:port]` of a backend endpoint, with or without URL scheme.
+func endpointHost(endpoint string) string {
+	if strings.Contains(endpoint, "://") {
+		u, err := url.Parse(endpoint)
+		if err != nil {
+			return ""
+		}
+		return u.Host
+	}
+	endpoint = stripUserinfo(endpoint)
+	if i := strings.Index(endpoint, "/"); i >= 0 {
+		endpoint = endpoint[:i]
+	}
+	return endpoint
+}
+
+// Strip the `user:password@` part of an endpoint, with or without URL scheme.
+func stripUserinfo(endpoint string) string {
+	if i := strings.Index(endpoint, "://"); i >= 0 {
+		if u, err := url.Parse(endpoint); err == nil {
+			u.User = nil
+			return u.String()
+		}
+		return endpoint[:i+3]
+	}
+	if i := strings.LastIndex(endpoint, "@"); i >= 0 {
+		return endpoint[i+1:]
+	}
+	return endpoint
+}
+
+// Check that every backend endpoint, including registry mirrors, the blob redirected host
+// and the proxy, the daemon configuration refers to is on the allowlist. An entry matches
+// the host alone or the host with port.
+func checkBackendAllowed(c daemonconfig.DaemonConfig, allowed []string) error {
+	if len(allowed) == 0 {
+		return nil
+	}
+	_, backend := c.StorageBackend()
+	if backend == nil {
+		return nil
+	}
+
+	endpoints := []string{backend.Host, backend.EndPoint, backend.BlobRedirectedHost, backend.Proxy.URL}
+	for _, m := range backend.Mirrors {
+		endpoints = append(endpoints, m.Host)
+	}
+	for _, endpoint := range endpoints {
+		if endpoint == "" {
+			continue
+		}
+		host := endpointHost(endpoint)
+		hostname := host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			hostname = h
+		}
+		permitted := false
+		for _, a := range allowed {
+			if a == host || a == hostname {
+				permitted = true
+				break
+			}
+		}
+		if !permitted {
+			return errors.Wrapf(ErrBackendNotAllowed, "backend %q", host)
+		}
+	}
+
+	return nil
+}
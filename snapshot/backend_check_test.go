@@ -0,0 +1,125 @@
+/*
+ * Copyright (c) 2023. Nydus Developers. All rights reserved.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package snapshot
+
+import (
+	"context"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/containerd/containerd/log"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/sirupsen/logrus/hooks/test"
+	"github.com/stretchr/testify/require"
+
+	"github.com/containerd/nydus-snapshotter/config"
+	"github.com/containerd/nydus-snapshotter/config/daemonconfig"
+)
+
+func TestBackendAddress(t *testing.T) {
+	c, err := daemonconfig.ParseDaemonConfig(config.FsDriverFusedev, []byte(fuseConfigContent))
+	require.NoError(t, err)
+	require.Equal(t, "docker.io:443", backendAddress(c))
+
+	c, err = daemonconfig.ParseDaemonConfig(config.FsDriverFscache, []byte(fscacheConfigContent))
+	require.NoError(t, err)
+	_, backend := c.StorageBackend()
+	backend.EndPoint = "http://oss.local:8080"
+	require.Equal(t, "oss.local:8080", backendAddress(c))
+}
+
+func TestCheckBackendReachable(t *testing.T) {
+	c, err := daemonconfig.ParseDaemonConfig(config.FsDriverFusedev, []byte(fuseConfigContent))
+	require.NoError(t, err)
+
+	logger, hook := test.NewNullLogger()
+	ctx := log.WithLogger(context.TODO(), logrus.NewEntry(logger))
+
+	reachable := func(context.Context, string, string) (net.Conn, error) {
+		client, server := net.Pipe()
+		server.Close()
+		return client, nil
+	}
+	require.NoError(t, checkBackendReachable(ctx, c, reachable))
+	require.Empty(t, hook.AllEntries())
+
+	unreachable := func(context.Context, string, string) (net.Conn, error) {
+		return nil, errors.New("connection refused")
+	}
+	require.Error(t, checkBackendReachable(ctx, c, unreachable))
+	require.Len(t, hook.AllEntries(), 1)
+	require.Equal(t, logrus.WarnLevel, hook.LastEntry().Level)
+	require.Contains(t, hook.LastEntry().Message, "docker.io:443")
+}
+
+func TestBackendCheckerDedup(t *testing.T) {
+	fuse, err := daemonconfig.ParseDaemonConfig(config.FsDriverFusedev, []byte(fuseConfigContent))
+	require.NoError(t, err)
+	fscache, err := daemonconfig.ParseDaemonConfig(config.FsDriverFscache, []byte(fscacheConfigContent))
+	require.NoError(t, err)
+
+	var dials int32
+	b := newBackendChecker(func(context.Context, string, string) (net.Conn, error) {
+		atomic.AddInt32(&dials, 1)
+		return nil, errors.New("connection refused")
+	})
+	ctx := log.WithLogger(context.TODO(), logrus.NewEntry(logrus.New()))
+
+	require.True(t, b.check(ctx, fuse))
+	// The same backend isn't checked again in the interval, another one is.
+	require.False(t, b.check(ctx, fuse))
+	require.True(t, b.check(ctx, fscache))
+	require.Eventually(t, func() bool { return atomic.LoadInt32(&dials) == 2 }, time.Second, 10*time.Millisecond)
+
+	// Checked again once the interval passes, and expired entries are dropped.
+	b.mu.Lock()
+	for addr := range b.checked {
+		b.checked[addr] = time.Now().Add(-backendCheckInterval)
+	}
+	b.mu.Unlock()
+	require.True(t, b.check(ctx, fuse))
+	require.Len(t, b.checked, 1)
+}
+
+func TestCheckBackendAllowed(t *testing.T) {
+	fuse, err := daemonconfig.ParseDaemonConfig(config.FsDriverFusedev, []byte(fuseConfigContent))
+	require.NoError(t, err)
+	fscache, err := daemonconfig.ParseDaemonConfig(config.FsDriverFscache, []byte(fscacheConfigContent))
+	require.NoError(t, err)
+
+	require.NoError(t, checkBackendAllowed(fuse, nil))
+	require.NoError(t, checkBackendAllowed(fuse, []string{"docker.io", "mirror1.local", "mirror2.local:5000"}))
+	require.NoError(t, checkBackendAllowed(fscache, []string{"oss-cn-hangzhou.aliyuncs.com"}))
+
+	// A mirror not on the allowlist rejects the mount.
+	err = checkBackendAllowed(fuse, []string{"docker.io", "mirror1.local:5000"})
+	require.True(t, errors.Is(err, ErrBackendNotAllowed))
+	require.ErrorContains(t, err, "mirror2.local:5000")
+	// So does a port other than the allowed one.
+	err = checkBackendAllowed(fuse, []string{"docker.io", "mirror1.local:443", "mirror2.local"})
+	require.True(t, errors.Is(err, ErrBackendNotAllowed))
+	err = checkBackendAllowed(fscache, []string{"docker.io"})
+	require.True(t, errors.Is(err, ErrBackendNotAllowed))
+
+	// Blobs may be fetched from the redirected host or through the proxy.
+	allowed := []string{"docker.io", "mirror1.local", "mirror2.local"}
+	_, backend := fuse.StorageBackend()
+	backend.BlobRedirectedHost = "blobs.local"
+	err = checkBackendAllowed(fuse, allowed)
+	require.True(t, errors.Is(err, ErrBackendNotAllowed))
+	require.ErrorContains(t, err, "blobs.local")
+	require.NoError(t, checkBackendAllowed(fuse, append(allowed, "blobs.local")))
+
+	backend.Proxy.URL = "http://proxy.local:65001"
+	err = checkBackendAllowed(fuse, append(allowed, "blobs.local"))
+	require.True(t, errors.Is(err, ErrBackendNotAllowed))
+	require.ErrorContains(t, err, "proxy.local:65001")
+	require.NoError(t, checkBackendAllowed(fuse, append(allowed, "blobs.local", "proxy.local")))
+}
@@ -0,0 +1,99 @@
+/*
+ * Copyright (c) 2023. Nydus Developers. All rights reserved.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package snapshot
+
+import (
+	"os"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/containerd/nydus-snapshotter/config/daemonconfig"
+)
+
+type configCacheKey struct {
+	daemonID   string
+	snapshotID string
+}
+
+type configCacheEntry struct {
+	modTime time.Time
+	config  daemonconfig.DaemonConfig
+	content string
+}
+
+// Marshaled instance configurations of shared daemons, so that mounting the same
+// snapshot again doesn't read and marshal its configuration file again.
+// An entry is reloaded once the configuration file is modified.
+// A nil cache disables caching.
+type configContentCache struct {
+	mu      sync.Mutex
+	entries map[configCacheKey]configCacheEntry
+}
+
+func newConfigContentCache() *configContentCache {
+	return &configContentCache{entries: map[configCacheKey]configCacheEntry{}}
+}
+
+func (c *configContentCache) load(daemonID, snapshotID, configFile string,
+	load func() (daemonconfig.DaemonConfig, error)) (daemonconfig.DaemonConfig, string, error) {
+	if c == nil {
+		return dumpConfig(load)
+	}
+
+	info, err := os.Stat(configFile)
+	if err != nil {
+		return nil, "", errors.Wrapf(err, "stat configuration file %s", configFile)
+	}
+
+	key := configCacheKey{daemonID: daemonID, snapshotID: snapshotID}
+	c.mu.Lock()
+	e, ok := c.entries[key]
+	c.mu.Unlock()
+	if ok && e.modTime.Equal(info.ModTime()) {
+		return e.config, e.content, nil
+	}
+
+	cfg, content, err := dumpConfig(load)
+	if err != nil {
+		return nil, "", err
+	}
+	c.mu.Lock()
+	c.entries[key] = configCacheEntry{modTime: info.ModTime(), config: cfg, content: content}
+	c.mu.Unlock()
+
+	return cfg, content, nil
+}
+
+// Drop the entries of a removed snapshot.
+func (c *configContentCache) remove(snapshotID string) {
+	if c == nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for key := range c.entries {
+		if key.snapshotID == snapshotID {
+			delete(c.entries, key)
+		}
+	}
+}
+
+func dumpConfig(load func() (daemonconfig.DaemonConfig, error)) (daemonconfig.DaemonConfig, string, error) {
+	cfg, err := load()
+	if err != nil {
+		return nil, "", err
+	}
+	content, err := cfg.DumpString()
+	if err != nil {
+		return nil, "", errors.Wrapf(err, "failed to marshal config")
+	}
+
+	return cfg, content, nil
+}
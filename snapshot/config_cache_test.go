@@ -0,0 +1,96 @@
+/*
+ * Copyright (c) 2023. Nydus Developers. All rights reserved.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package snapshot
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/containerd/nydus-snapshotter/config"
+	"github.com/containerd/nydus-snapshotter/config/daemonconfig"
+)
+
+func TestConfigContentCache(t *testing.T) {
+	configFile := filepath.Join(t.TempDir(), "config.json")
+	require.NoError(t, os.WriteFile(configFile, []byte(fuseConfigContent), 0600))
+
+	loads := 0
+	load := func() (daemonconfig.DaemonConfig, error) {
+		loads++
+		return daemonconfig.NewDaemonConfig(config.FsDriverFusedev, configFile)
+	}
+
+	cache := newConfigContentCache()
+	_, content, err := cache.load("daemon", "1", configFile, load)
+	require.NoError(t, err)
+	require.Contains(t, content, "docker.io")
+	_, cached, err := cache.load("daemon", "1", configFile, load)
+	require.NoError(t, err)
+	require.Equal(t, content, cached)
+	require.Equal(t, 1, loads)
+
+	// Another snapshot has its own entry.
+	_, _, err = cache.load("daemon", "2", configFile, load)
+	require.NoError(t, err)
+	require.Equal(t, 2, loads)
+
+	// Modifying the file invalidates the entry. Set the mtime explicitly in case
+	// the filesystem timestamps are too coarse to tell the writes apart.
+	require.NoError(t, os.WriteFile(configFile, []byte(fscacheConfigContent), 0600))
+	modTime := time.Now().Add(time.Hour)
+	require.NoError(t, os.Chtimes(configFile, modTime, modTime))
+	_, content, err = cache.load("daemon", "1", configFile, func() (daemonconfig.DaemonConfig, error) {
+		loads++
+		return daemonconfig.NewDaemonConfig(config.FsDriverFscache, configFile)
+	})
+	require.NoError(t, err)
+	require.Equal(t, 3, loads)
+	require.Contains(t, content, "oss-cn-hangzhou.aliyuncs.com")
+
+	cache.remove("1")
+	require.Len(t, cache.entries, 1)
+
+	// A missing configuration file isn't served from the cache.
+	require.NoError(t, os.Remove(configFile))
+	_, _, err = cache.load("daemon", "2", configFile, load)
+	require.Error(t, err)
+
+	// A nil cache always loads.
+	var nilCache *configContentCache
+	require.NoError(t, os.WriteFile(configFile, []byte(fuseConfigContent), 0600))
+	for i := 0; i < 2; i++ {
+		_, _, err = nilCache.load("daemon", "1", configFile, load)
+		require.NoError(t, err)
+	}
+	require.Equal(t, 5, loads)
+	nilCache.remove("1")
+}
+
+func BenchmarkConfigContentCache(b *testing.B) {
+	configFile := filepath.Join(b.TempDir(), "config.json")
+	require.NoError(b, os.WriteFile(configFile, []byte(fuseConfigContent), 0600))
+	load := func() (daemonconfig.DaemonConfig, error) {
+		return daemonconfig.NewDaemonConfig(config.FsDriverFusedev, configFile)
+	}
+
+	for name, cache := range map[string]*configContentCache{
+		"uncached": nil,
+		"cached":   newConfigContentCache(),
+	} {
+		b.Run(name, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				if _, _, err := cache.load("daemon", "1", configFile, load); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,141 @@
+/*
+ * Copyright (c) 2023. Nydus Developers. All rights reserved.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package snapshot
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/containerd/containerd/mount"
+)
+
+// Compare a mount emitted by the current code against one recorded from a previous
+// version, listing the differences which may break consumers of the old mount:
+// changed type or source, added, removed or changed options, a changed `extraoption`
+// encoding and payload fields removed or retyped. The order of options, payload values
+// and the checksum and filesystem version options depending on them are not compared.
+func CompareMountCompatibility(old, new mount.Mount) []string {
+	var diffs []string
+	if old.Type != new.Type {
+		diffs = append(diffs, fmt.Sprintf("type changed from %q to %q", old.Type, new.Type))
+	}
+	if old.Source != new.Source {
+		diffs = append(diffs, fmt.Sprintf("source changed from %q to %q", old.Source, new.Source))
+	}
+
+	oldOptions, oldExtra := splitMountOptions(old.Options)
+	newOptions, newExtra := splitMountOptions(new.Options)
+	for key, value := range oldOptions {
+		v, ok := newOptions[key]
+		switch {
+		case !ok:
+			diffs = append(diffs, fmt.Sprintf("option %s removed", key))
+		case key == strings.TrimSuffix(extraOptionChecksumKey, "="), key == strings.TrimSuffix(fsVersionOptionKey, "="):
+		case v != value:
+			diffs = append(diffs, fmt.Sprintf("option %s changed from %q to %q", key, value, v))
+		}
+	}
+	for key := range newOptions {
+		if _, ok := oldOptions[key]; !ok {
+			diffs = append(diffs, fmt.Sprintf("option %s added", key))
+		}
+	}
+
+	diffs = append(diffs, compareExtraOptions(oldExtra, newExtra)...)
+	sort.Strings(diffs)
+
+	return diffs
+}
+
+// Split mount options into plain options by key and the extra option.
+func splitMountOptions(options []string) (map[string]string, string) {
+	plain := make(map[string]string, len(options))
+	var extra string
+	for _, opt := range options {
+		if isExtraOption(opt) {
+			extra = opt
+			continue
+		}
+		key, value, _ := strings.Cut(opt, "=")
+		plain[key] = value
+	}
+	return plain, extra
+}
+
+func compareExtraOptions(old, new string) []string {
+	switch {
+	case old == "" && new == "":
+		return nil
+	case old == "":
+		return []string{"extra option added"}
+	case new == "":
+		return []string{"extra option removed"}
+	}
+
+	oldKey, _, _ := strings.Cut(old, "=")
+	newKey, _, _ := strings.Cut(new, "=")
+	if oldKey != newKey {
+		return []string{fmt.Sprintf("extra option encoding changed from %s to %s", oldKey, newKey)}
+	}
+
+	oldFields, err := extraOptionSchema(old)
+	if err != nil {
+		return []string{fmt.Sprintf("old extra option undecodable: %v", err)}
+	}
+	newFields, err := extraOptionSchema(new)
+	if err != nil {
+		return []string{fmt.Sprintf("new extra option undecodable: %v", err)}
+	}
+
+	// Added fields are ignored by older decoders, only removed or retyped ones break them.
+	var diffs []string
+	for field, kind := range oldFields {
+		k, ok := newFields[field]
+		switch {
+		case !ok:
+			diffs = append(diffs, fmt.Sprintf("extra option field %s removed", field))
+		case k != kind:
+			diffs = append(diffs, fmt.Sprintf("extra option field %s changed from %s to %s", field, kind, k))
+		}
+	}
+
+	return diffs
+}
+
+// Get the JSON kind of each top level field of the extra option payload. The schema
+// version is kept with its value since it tells consumers how to decode the payload.
+func extraOptionSchema(opt string) (map[string]string, error) {
+	data, _, err := extraOptionPayload(opt)
+	if err != nil {
+		return nil, err
+	}
+	var fields map[string]interface{}
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return nil, err
+	}
+
+	schema := make(map[string]string, len(fields))
+	for field, value := range fields {
+		switch v := value.(type) {
+		case string:
+			schema[field] = "string"
+		case float64:
+			schema[field] = "number"
+		case bool:
+			schema[field] = "bool"
+		default:
+			schema[field] = fmt.Sprintf("%T", v)
+		}
+	}
+	if v, ok := fields["schema_version"]; ok {
+		schema["schema_version"] = fmt.Sprintf("version %v", v)
+	}
+
+	return schema, nil
+}
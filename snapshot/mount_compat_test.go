@@ -0,0 +1,69 @@
+/*
+ * Copyright (c) 2023. Nydus Developers. All rights reserved.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package snapshot
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/containerd/containerd/mount"
+
+	"github.com/containerd/nydus-snapshotter/config"
+	"github.com/containerd/nydus-snapshotter/pkg/layout"
+)
+
+func TestCompareMountCompatibility(t *testing.T) {
+	overlayOptions := []string{"workdir=/work", "upperdir=/upper", "lowerdir=/lower1:/lower2"}
+	build := func(opt *ExtraOption, options []string, enc extraOptionEncoding) mount.Mount {
+		mounts, err := buildNydusOverlayMount(opt, options, enc)
+		require.NoError(t, err)
+		return mounts[0]
+	}
+	opt := newExtraOption("/snapshots/1/fs/image/image.boot", fuseConfigContent, "/snapshots/2", layout.RafsV6)
+	old := build(opt, overlayOptions, extraOptionEncoding{checksum: true})
+
+	// Benign: options reordered, payload values and thus checksum changed.
+	other := newExtraOption("/snapshots/3/fs/image/image.boot", fscacheConfigContent, "/snapshots/4", layout.RafsV5)
+	benign := build(other, overlayOptions, extraOptionEncoding{placement: config.ExtraOptionPlacementFirst, checksum: true})
+	require.Empty(t, CompareMountCompatibility(old, benign))
+	reordered := build(opt, []string{"lowerdir=/lower1:/lower2", "upperdir=/upper", "workdir=/work"}, extraOptionEncoding{checksum: true})
+	require.Empty(t, CompareMountCompatibility(old, reordered))
+
+	// Breaking: type, options and extra option encoding.
+	breaking := build(opt, []string{"workdir=/work", "lowerdir=/lower2:/lower1", "metacopy=on"},
+		extraOptionEncoding{format: config.ExtraOptionFormatRawJSON, subtype: "nydus"})
+	require.Equal(t, []string{
+		`extra option encoding changed from extraoption to extraoption_json`,
+		`option extraoption_checksum removed`,
+		`option lowerdir changed from "/lower1:/lower2" to "/lower2:/lower1"`,
+		`option metacopy added`,
+		`option upperdir removed`,
+		`type changed from "fuse.nydus-overlayfs" to "fuse.nydus"`,
+	}, CompareMountCompatibility(old, breaking))
+
+	// Benign: payload field added.
+	summarized := *opt
+	summarized.BackendType = "registry"
+	added := build(&summarized, overlayOptions, extraOptionEncoding{checksum: true})
+	require.Empty(t, CompareMountCompatibility(old, added))
+
+	// Breaking: payload field removed, the added one is still not reported.
+	v0 := *opt
+	v0.SchemaVersion = ExtraOptionSchemaV0
+	v0.BackendType = "registry"
+	schema := build(&v0, overlayOptions, extraOptionEncoding{checksum: true, fields: []string{"source", "config", "backend_type"}})
+	require.Equal(t, []string{
+		"extra option field schema_version removed",
+	}, CompareMountCompatibility(old, schema))
+
+	require.Equal(t, []string{
+		"extra option removed",
+		"option extraoption_checksum removed",
+		`source changed from "overlay" to "none"`,
+	}, CompareMountCompatibility(old, mount.Mount{Type: old.Type, Source: "none", Options: overlayOptions}))
+}
@@ -0,0 +1,82 @@
+/*
+ * Copyright (c) 2023. Nydus Developers. All rights reserved.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package snapshot
+
+import (
+	"encoding/json"
+	"strings"
+
+	"github.com/containerd/containerd/mount"
+	"github.com/pkg/errors"
+
+	"github.com/containerd/nydus-snapshotter/config/daemonconfig"
+)
+
+type dumpedExtraOption struct {
+	ExtraOption
+	// Daemon configuration decoded with secrets redacted
+	Config interface{} `json:"config"`
+}
+
+type dumpedMount struct {
+	Type        string             `json:"type"`
+	Source      string             `json:"source"`
+	Options     []string           `json:"options"`
+	ExtraOption *dumpedExtraOption `json:"extra_option,omitempty"`
+}
+
+// Dump mounts as a JSON document for debugging, with the extra option decoded
+// and the credentials in its daemon configuration redacted.
+func DumpMountsJSON(mounts []mount.Mount) ([]byte, error) {
+	dumped := make([]dumpedMount, 0, len(mounts))
+	for _, m := range mounts {
+		d := dumpedMount{Type: m.Type, Source: m.Source, Options: []string{}}
+		for _, opt := range m.Options {
+			if !isExtraOption(opt) {
+				d.Options = append(d.Options, opt)
+				continue
+			}
+			e, err := decodeExtraOption(opt)
+			if err != nil {
+				return nil, errors.Wrapf(err, "decode extra option of mount %s", m.Type)
+			}
+			d.ExtraOption = &dumpedExtraOption{ExtraOption: *e, Config: redactConfig(e.Config)}
+		}
+		dumped = append(dumped, d)
+	}
+
+	return json.MarshalIndent(dumped, "", "  ")
+}
+
+// Decode the daemon configuration redacted the same way as it's logged. Content
+// which can't be parsed as a daemon configuration is redacted as a whole.
+func redactConfig(content string) interface{} {
+	if content == "" {
+		return nil
+	}
+	if strings.HasPrefix(content, extraOptionConfigFileRef) {
+		return content
+	}
+
+	fsDriver, err := daemonconfig.DetectFsDriver([]byte(content))
+	if err != nil {
+		return daemonconfig.RedactedPlaceholder
+	}
+	c, err := daemonconfig.ParseDaemonConfig(fsDriver, []byte(content))
+	if err != nil {
+		return daemonconfig.RedactedPlaceholder
+	}
+	redacted, err := c.DumpStringRedacted()
+	if err != nil {
+		return daemonconfig.RedactedPlaceholder
+	}
+	var config interface{}
+	if err := json.Unmarshal([]byte(redacted), &config); err != nil {
+		return daemonconfig.RedactedPlaceholder
+	}
+	return config
+}
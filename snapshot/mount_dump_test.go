@@ -0,0 +1,74 @@
+/*
+ * Copyright (c) 2023. Nydus Developers. All rights reserved.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package snapshot
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/containerd/nydus-snapshotter/config/daemonconfig"
+	"github.com/containerd/nydus-snapshotter/pkg/layout"
+)
+
+func TestDumpMountsJSON(t *testing.T) {
+	opt := newExtraOption("/snapshots/1/fs/image/image.boot", fuseConfigContent, "/snapshots/2", layout.RafsV6)
+	mounts, err := buildNydusOverlayMount(opt, []string{"workdir=/work", "upperdir=/upper"}, extraOptionEncoding{})
+	require.NoError(t, err)
+	mounts = append(mounts, overlayMount([]string{"lowerdir=/lower"})...)
+
+	data, err := DumpMountsJSON(mounts)
+	require.NoError(t, err)
+	require.NotContains(t, string(data), "dXNlcjpwYXNz")
+
+	var dumped []map[string]interface{}
+	require.NoError(t, json.Unmarshal(data, &dumped))
+	require.Len(t, dumped, 2)
+	require.Equal(t, []interface{}{"workdir=/work", "upperdir=/upper"}, dumped[0]["options"])
+
+	extra := dumped[0]["extra_option"].(map[string]interface{})
+	require.Equal(t, "/snapshots/1/fs/image/image.boot", extra["source"])
+	require.Equal(t, "/snapshots/2", extra["snapshotdir"])
+	require.Equal(t, layout.RafsV6, extra["fs_version"])
+	backend := extra["config"].(map[string]interface{})["device"].(map[string]interface{})["backend"].(map[string]interface{})
+	backendConfig := backend["config"].(map[string]interface{})
+	require.Equal(t, "docker.io", backendConfig["host"])
+	require.Equal(t, daemonconfig.RedactedPlaceholder, backendConfig["auth"])
+
+	require.NotContains(t, dumped[1], "extra_option")
+
+	// Secrets in the fscache configuration are redacted as well.
+	opt = newExtraOption("/bootstrap", fscacheConfigContent, "/snapshots/2", layout.RafsV6)
+	mounts, err = buildNydusOverlayMount(opt, nil, extraOptionEncoding{})
+	require.NoError(t, err)
+	data, err = DumpMountsJSON(mounts)
+	require.NoError(t, err)
+	require.NotContains(t, string(data), `"sk"`)
+	require.NotContains(t, string(data), `"ak"`)
+	require.Contains(t, string(data), "oss-cn-hangzhou.aliyuncs.com")
+
+	// So are the credentials in mirror headers.
+	withHeaders := strings.Replace(fuseConfigContent, `{"host": "http://mirror1.local:5000"}`,
+		`{"host": "http://mirror1.local:5000", "headers": {"Authorization": "Basic bWlycm9yOnBhc3M="}}`, 1)
+	opt = newExtraOption("/bootstrap", withHeaders, "/snapshots/2", layout.RafsV6)
+	mounts, err = buildNydusOverlayMount(opt, nil, extraOptionEncoding{})
+	require.NoError(t, err)
+	data, err = DumpMountsJSON(mounts)
+	require.NoError(t, err)
+	require.NotContains(t, string(data), "bWlycm9yOnBhc3M=")
+	require.Contains(t, string(data), "http://mirror1.local:5000")
+
+	// Content not parsed as a daemon configuration is redacted as a whole.
+	opt = newExtraOption("/bootstrap", `{"auth": "secret"}`, "/snapshots/2", layout.RafsV6)
+	mounts, err = buildNydusOverlayMount(opt, nil, extraOptionEncoding{})
+	require.NoError(t, err)
+	data, err = DumpMountsJSON(mounts)
+	require.NoError(t, err)
+	require.NotContains(t, string(data), "secret")
+}
@@ -0,0 +1,467 @@
+/*
+ * Copyright (c) 2023. Nydus Developers. All rights reserved.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package snapshot
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"strings"
+
+	"github.com/pkg/errors"
+
+	"github.com/containerd/containerd/mount"
+
+	"github.com/containerd/nydus-snapshotter/config"
+	"github.com/containerd/nydus-snapshotter/pkg/layout"
+)
+
+// The option key tells consumers how the `ExtraOption` is serialized.
+const (
+	extraOptionKey         = "extraoption="
+	extraOptionRawJSONKey  = "extraoption_json="
+	extraOptionGzipKey     = "extraoption_gz="
+	extraOptionChecksumKey = "extraoption_checksum="
+	fsVersionOptionKey     = "fs_version="
+)
+
+// A framed `extraoption` payload starts with the magic, followed by the little-endian
+// uint32 length and crc32 (IEEE) of the JSON payload.
+const (
+	extraOptionHeaderMagic = "NXO1"
+	extraOptionHeaderSize  = 12
+)
+
+// Returned when a framed `extraoption` payload doesn't match its header.
+var ErrCorruptedExtraOption = errors.New("corrupted extraoption")
+
+// Decode the json content of an `extraoption` according to its schema version.
+func DecodeExtraOption(data []byte) (*ExtraOption, error) {
+	var opt ExtraOption
+	if err := json.Unmarshal(data, &opt); err != nil {
+		return nil, errors.Wrapf(err, "unmarshal extra option")
+	}
+
+	switch opt.SchemaVersion {
+	case ExtraOptionSchemaV0, ExtraOptionSchemaV1:
+		// v1 only adds the schema version on top of v0.
+	default:
+		return nil, errors.Errorf("unsupported extra option schema version %d", opt.SchemaVersion)
+	}
+
+	return &opt, nil
+}
+
+// How the extra option is encoded into nydus-overlayfs mount options
+type extraOptionEncoding struct {
+	placement string
+	format    string
+	checksum  bool
+	// Emit the filesystem version in plain text
+	fsVersion bool
+	// Frame base64 encoded payload with a header, ignored for raw JSON
+	header bool
+	// JSON fields to emit, all fields if empty
+	fields []string
+	// FUSE subtype of the mount, defaults to "nydus-overlayfs"
+	subtype string
+}
+
+func (o *snapshotter) extraOptionEncoding(fsDriver string) extraOptionEncoding {
+	return extraOptionEncoding{
+		placement: o.encoding.placement,
+		format:    o.encoding.format,
+		checksum:  o.encoding.checksum,
+		fsVersion: o.encoding.fsVersion,
+		header:    o.encoding.header,
+		fields:    o.encoding.fields[fsDriver],
+		subtype:   o.encoding.fuseSubtype,
+	}
+}
+
+// Assemble a nydus-overlayfs mount from its inputs with the default encoding, i.e. a
+// base64 encoded `extraoption` appended to the overlay options. It does no I/O and
+// needs no snapshotter, for external tooling building the mount on its own.
+func BuildNydusOverlayMount(source, configContent, snapshotDir, version string, overlayOptions []string) ([]mount.Mount, error) {
+	extraOption := newExtraOption(source, configContent, snapshotDir, version)
+	if err := extraOption.Validate(); err != nil {
+		return nil, err
+	}
+
+	return buildNydusOverlayMount(extraOption, overlayOptions, extraOptionEncoding{})
+}
+
+// Pack the `ExtraOption` into the overlay options of a nydus-overlayfs mount.
+func buildNydusOverlayMount(extraOption *ExtraOption, overlayOptions []string, enc extraOptionEncoding) ([]mount.Mount, error) {
+	data, err := json.Marshal(extraOption)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to marshal NydusOption")
+	}
+	if len(enc.fields) > 0 {
+		if data, err = maskExtraOption(data, enc.fields); err != nil {
+			return nil, err
+		}
+	}
+	payload := data
+	if enc.header && enc.format != config.ExtraOptionFormatRawJSON {
+		payload = frameExtraOption(data)
+	}
+	opt, err := formatExtraOption(payload, enc.format)
+	if err != nil {
+		return nil, err
+	}
+
+	opts := []string{opt}
+	if enc.checksum {
+		opts = append(opts, extraOptionChecksumKey+extraOptionChecksum(data))
+	}
+	if enc.fsVersion {
+		// Replace any stale one so that the option appears exactly once.
+		kept := make([]string, 0, len(overlayOptions))
+		for _, o := range overlayOptions {
+			if !strings.HasPrefix(o, fsVersionOptionKey) {
+				kept = append(kept, o)
+			}
+		}
+		overlayOptions = kept
+		opts = append(opts, fsVersionOptionKey+extraOption.Version)
+	}
+	overlayOptions, err = placeExtraOption(overlayOptions, enc.placement, opts...)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to add extra option")
+	}
+
+	subtype := enc.subtype
+	if subtype == "" {
+		subtype = config.DefaultFuseSubtype
+	}
+
+	return []mount.Mount{
+		{
+			Type:    "fuse." + subtype,
+			Source:  "overlay",
+			Options: overlayOptions,
+		},
+	}, nil
+}
+
+// Keep only the selected fields of the marshaled extra option. The required fields
+// and the schema version are always kept, so a masked extra option still validates.
+func maskExtraOption(data []byte, fields []string) ([]byte, error) {
+	keep := map[string]bool{"schema_version": true}
+	for _, f := range extraOptionRequiredFields {
+		keep[f] = true
+	}
+	for _, f := range fields {
+		if !config.IsExtraOptionField(f) {
+			return nil, errors.Errorf("unknown extra option field %q", f)
+		}
+		keep[f] = true
+	}
+
+	var m map[string]json.RawMessage
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, errors.Wrapf(err, "unmarshal extra option")
+	}
+	for k := range m {
+		if !keep[k] {
+			delete(m, k)
+		}
+	}
+
+	return json.Marshal(m)
+}
+
+func formatExtraOption(no []byte, format string) (string, error) {
+	switch format {
+	case "", config.ExtraOptionFormatBase64JSON:
+		// base64 to filter easily in `nydus-overlayfs`
+		return fmt.Sprintf("%s%s", extraOptionKey, base64.StdEncoding.EncodeToString(no)), nil
+	case config.ExtraOptionFormatRawJSON:
+		return fmt.Sprintf("%s%s", extraOptionRawJSONKey, no), nil
+	case config.ExtraOptionFormatBase64GzipJSON:
+		var buf bytes.Buffer
+		w := gzip.NewWriter(&buf)
+		if _, err := w.Write(no); err != nil {
+			return "", errors.Wrapf(err, "compress extra option")
+		}
+		if err := w.Close(); err != nil {
+			return "", errors.Wrapf(err, "compress extra option")
+		}
+		return fmt.Sprintf("%s%s", extraOptionGzipKey, base64.StdEncoding.EncodeToString(buf.Bytes())), nil
+	default:
+		return "", errors.Errorf("invalid extra option format %q", format)
+	}
+}
+
+// Prepend the header to the JSON payload.
+func frameExtraOption(data []byte) []byte {
+	framed := make([]byte, extraOptionHeaderSize, extraOptionHeaderSize+len(data))
+	copy(framed, extraOptionHeaderMagic)
+	binary.LittleEndian.PutUint32(framed[4:8], uint32(len(data)))
+	binary.LittleEndian.PutUint32(framed[8:12], crc32.ChecksumIEEE(data))
+	return append(framed, data...)
+}
+
+// Strip and verify the header of a framed payload. A legacy payload without the
+// header is returned as is, telling whether it was framed.
+func unframeExtraOption(data []byte) ([]byte, bool, error) {
+	if !bytes.HasPrefix(data, []byte(extraOptionHeaderMagic)) {
+		return data, false, nil
+	}
+	if len(data) < extraOptionHeaderSize {
+		return nil, true, errors.Wrapf(ErrCorruptedExtraOption, "truncated header")
+	}
+	length := binary.LittleEndian.Uint32(data[4:8])
+	payload := data[extraOptionHeaderSize:]
+	if uint64(len(payload)) != uint64(length) {
+		return nil, true, errors.Wrapf(ErrCorruptedExtraOption, "payload of %d bytes, expect %d", len(payload), length)
+	}
+	if crc32.ChecksumIEEE(payload) != binary.LittleEndian.Uint32(data[8:12]) {
+		return nil, true, errors.Wrapf(ErrCorruptedExtraOption, "crc32 mismatch")
+	}
+
+	return payload, true, nil
+}
+
+// Hex encoded sha256 digest of the JSON payload before base64 encoding, so that
+// consumers of the mount can detect a payload corrupted in transit. nydus-overlayfs
+// doesn't verify it.
+func extraOptionChecksum(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// Deserialize the `ExtraOption` from a mount option according to its format tag.
+func decodeExtraOption(opt string) (*ExtraOption, error) {
+	data, _, err := extraOptionPayload(opt)
+	if err != nil {
+		return nil, err
+	}
+	return DecodeExtraOption(data)
+}
+
+// Parse an `extraoption` mount option in any of the emitted formats, the counterpart
+// of the encoder for consumers of nydus-overlayfs mounts. Fields nydus-overlayfs
+// can't mount without must not be empty.
+func ParseExtraOption(option string) (*ExtraOption, error) {
+	extraOption, err := decodeExtraOption(option)
+	if err != nil {
+		return nil, err
+	}
+	if err := extraOption.Validate(); err != nil {
+		return nil, err
+	}
+
+	return extraOption, nil
+}
+
+// Decode the extra option of a nydus-overlayfs mount and validate it, the
+// counterpart of building the mount for consumers' self-testing.
+func VerifyMountExtraOption(m mount.Mount) (*ExtraOption, error) {
+	var opts []string
+	for _, opt := range m.Options {
+		if isExtraOption(opt) {
+			opts = append(opts, opt)
+		}
+	}
+	if len(opts) != 1 {
+		return nil, errors.Errorf("expect exactly one extra option in mount %s, got %d", m.Type, len(opts))
+	}
+
+	extraOption, err := decodeExtraOption(opts[0])
+	if err != nil {
+		return nil, err
+	}
+	if err := extraOption.Validate(); err != nil {
+		return nil, err
+	}
+	if !layout.IsKnownFsVersion(extraOption.Version) {
+		return nil, errors.Errorf("unknown filesystem version %q", extraOption.Version)
+	}
+
+	return extraOption, nil
+}
+
+// Get the JSON payload of an extra option and the format it's encoded in.
+func extraOptionPayload(opt string) ([]byte, string, error) {
+	data, format, _, err := decodeExtraOptionPayload(opt)
+	return data, format, err
+}
+
+// Like extraOptionPayload, also telling whether the payload was framed with a header.
+func decodeExtraOptionPayload(opt string) ([]byte, string, bool, error) {
+	switch {
+	case strings.HasPrefix(opt, extraOptionKey):
+		data, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(opt, extraOptionKey))
+		if err != nil {
+			return nil, "", false, errors.Wrapf(err, "decode extra option")
+		}
+		data, framed, err := unframeExtraOption(data)
+		return data, config.ExtraOptionFormatBase64JSON, framed, err
+	case strings.HasPrefix(opt, extraOptionRawJSONKey):
+		return []byte(strings.TrimPrefix(opt, extraOptionRawJSONKey)), config.ExtraOptionFormatRawJSON, false, nil
+	case strings.HasPrefix(opt, extraOptionGzipKey):
+		compressed, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(opt, extraOptionGzipKey))
+		if err != nil {
+			return nil, "", false, errors.Wrapf(err, "decode extra option")
+		}
+		r, err := gzip.NewReader(bytes.NewReader(compressed))
+		if err != nil {
+			return nil, "", false, errors.Wrapf(err, "decompress extra option")
+		}
+		defer r.Close()
+		data, err := io.ReadAll(r)
+		if err != nil {
+			return nil, "", false, errors.Wrapf(err, "decompress extra option")
+		}
+		data, framed, err := unframeExtraOption(data)
+		return data, config.ExtraOptionFormatBase64GzipJSON, framed, err
+	default:
+		return nil, "", false, errors.Errorf("not an extra option")
+	}
+}
+
+// Replace the daemon configuration embedded in the extra option of a nydus-overlayfs
+// mount, keeping the other fields, the encoding and the options order. The checksum
+// option, if any, is updated accordingly.
+func UpdateMountConfig(m mount.Mount, newConfig string) (mount.Mount, error) {
+	if newConfig == "" {
+		return mount.Mount{}, errors.Errorf("empty config")
+	}
+
+	idx := -1
+	for i, opt := range m.Options {
+		if isExtraOption(opt) {
+			idx = i
+			break
+		}
+	}
+	if idx < 0 {
+		return mount.Mount{}, errors.Errorf("no extra option in mount %s", m.Type)
+	}
+
+	data, format, framed, err := decodeExtraOptionPayload(m.Options[idx])
+	if err != nil {
+		return mount.Mount{}, err
+	}
+	// Work on the raw fields so that fields this snapshotter doesn't know are kept.
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return mount.Mount{}, errors.Wrapf(err, "unmarshal extra option")
+	}
+	if fields["config"], err = json.Marshal(newConfig); err != nil {
+		return mount.Mount{}, errors.Wrapf(err, "marshal config")
+	}
+	if data, err = json.Marshal(fields); err != nil {
+		return mount.Mount{}, errors.Wrapf(err, "marshal extra option")
+	}
+	payload := data
+	if framed {
+		payload = frameExtraOption(data)
+	}
+	opt, err := formatExtraOption(payload, format)
+	if err != nil {
+		return mount.Mount{}, err
+	}
+
+	options := make([]string, len(m.Options))
+	copy(options, m.Options)
+	options[idx] = opt
+	for i, o := range options {
+		if strings.HasPrefix(o, extraOptionChecksumKey) {
+			options[i] = extraOptionChecksumKey + extraOptionChecksum(data)
+		}
+	}
+	m.Options = options
+
+	return m, nil
+}
+
+func isExtraOption(opt string) bool {
+	return strings.HasPrefix(opt, extraOptionKey) || strings.HasPrefix(opt, extraOptionRawJSONKey) ||
+		strings.HasPrefix(opt, extraOptionGzipKey)
+}
+
+// Put the `extraoption` first or last among the overlay options as required by the runtime.
+func placeExtraOption(overlayOptions []string, placement string, opts ...string) ([]string, error) {
+	if err := checkNoExtraOption(overlayOptions); err != nil {
+		return nil, err
+	}
+
+	switch placement {
+	case config.ExtraOptionPlacementFirst:
+		return append(opts, overlayOptions...), nil
+	case "", config.ExtraOptionPlacementLast:
+		return append(overlayOptions, opts...), nil
+	default:
+		return nil, errors.Errorf("invalid extra option placement %q", placement)
+	}
+}
+
+// Whether the mount is a nydus-overlayfs mount which needs the mount helper
+// installed on the node, rather than a plain overlay mount.
+func MountRequiresOverlayFsHelper(m mount.Mount) bool {
+	if !strings.HasPrefix(m.Type, "fuse.") {
+		return false
+	}
+	for _, opt := range m.Options {
+		if isExtraOption(opt) {
+			return true
+		}
+	}
+	return false
+}
+
+// Options emitted besides `extraoption` by the configuration, which nydus-overlayfs
+// doesn't strip before mounting overlayfs so a newer one is needed.
+func siblingExtraOptions(cfg *config.SnapshotConfig) []string {
+	var opts []string
+	switch cfg.ExtraOptionFormat {
+	case config.ExtraOptionFormatRawJSON:
+		opts = append(opts, strings.TrimSuffix(extraOptionRawJSONKey, "="))
+	case config.ExtraOptionFormatBase64GzipJSON:
+		opts = append(opts, strings.TrimSuffix(extraOptionGzipKey, "="))
+	}
+	if cfg.EmitExtraOptionChecksum {
+		opts = append(opts, strings.TrimSuffix(extraOptionChecksumKey, "="))
+	}
+	if cfg.EmitFsVersionOption {
+		opts = append(opts, strings.TrimSuffix(fsVersionOptionKey, "="))
+	}
+	return opts
+}
+
+// Add the configured overlay flags unless the option is already given.
+func mergeOverlayFlags(overlayOptions, flags []string) []string {
+	if len(flags) == 0 {
+		return overlayOptions
+	}
+
+	keys := map[string]bool{}
+	for _, opt := range overlayOptions {
+		key, _, _ := strings.Cut(opt, "=")
+		keys[key] = true
+	}
+	merged := append([]string{}, overlayOptions...)
+	for _, flag := range flags {
+		key, _, _ := strings.Cut(flag, "=")
+		if !keys[key] {
+			merged = append(merged, flag)
+			keys[key] = true
+		}
+	}
+
+	return merged
+}
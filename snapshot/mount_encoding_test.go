@@ -0,0 +1,466 @@
+/*
+ * Copyright (c) 2023. Nydus Developers. All rights reserved.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package snapshot
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/containerd/containerd/mount"
+
+	"github.com/containerd/nydus-snapshotter/config"
+	"github.com/containerd/nydus-snapshotter/pkg/layout"
+)
+
+func TestExtraOptionSchemaVersion(t *testing.T) {
+	opt := newExtraOption("/snapshots/1/fs/image/image.boot", fuseConfigContent, "/snapshots/2", layout.RafsV6)
+	require.Equal(t, ExtraOptionSchemaVersion, opt.SchemaVersion)
+
+	data, err := json.Marshal(opt)
+	require.NoError(t, err)
+	require.Contains(t, string(data), `"schema_version":1`)
+
+	decoded, err := DecodeExtraOption(data)
+	require.NoError(t, err)
+	require.Equal(t, opt, decoded)
+
+	// Payloads emitted by older snapshotters don't carry a schema version.
+	legacy := `{"source":"/snapshots/1/fs/image/image.boot","config":"{}","snapshotdir":"/snapshots/2","fs_version":"v5"}`
+	decoded, err = DecodeExtraOption([]byte(legacy))
+	require.NoError(t, err)
+	require.Equal(t, ExtraOptionSchemaV0, decoded.SchemaVersion)
+	require.Equal(t, layout.RafsV5, decoded.Version)
+
+	_, err = DecodeExtraOption([]byte(`{"source":"/bootstrap","schema_version":100}`))
+	require.Error(t, err)
+}
+
+func TestPlaceExtraOption(t *testing.T) {
+	overlayOptions := []string{"workdir=/work", "upperdir=/upper", "lowerdir=/lower"}
+	opt := extraOptionKey + "e30="
+
+	options, err := placeExtraOption(append([]string{}, overlayOptions...), "", opt)
+	require.NoError(t, err)
+	require.Equal(t, append(overlayOptions, opt), options)
+
+	options, err = placeExtraOption(append([]string{}, overlayOptions...), config.ExtraOptionPlacementLast, opt)
+	require.NoError(t, err)
+	require.Equal(t, opt, options[len(options)-1])
+
+	options, err = placeExtraOption(append([]string{}, overlayOptions...), config.ExtraOptionPlacementFirst, opt)
+	require.NoError(t, err)
+	require.Equal(t, append([]string{opt}, overlayOptions...), options)
+
+	_, err = placeExtraOption(append(overlayOptions, opt), config.ExtraOptionPlacementFirst, opt)
+	require.Error(t, err)
+
+	_, err = placeExtraOption(overlayOptions, "middle", opt)
+	require.Error(t, err)
+}
+
+func TestBuildNydusOverlayMount(t *testing.T) {
+	overlayOptions := []string{"workdir=/work", "upperdir=/upper", "lowerdir=/lower"}
+	opt := newExtraOption("/snapshots/1/fs/image/image.boot", fuseConfigContent, "/snapshots/2", layout.RafsV6)
+
+	mounts, err := buildNydusOverlayMount(opt, overlayOptions, extraOptionEncoding{})
+	require.NoError(t, err)
+	require.Len(t, mounts, 1)
+	require.Equal(t, "fuse.nydus-overlayfs", mounts[0].Type)
+	require.Len(t, mounts[0].Options, len(overlayOptions)+1)
+
+	encoded := strings.TrimPrefix(mounts[0].Options[len(overlayOptions)], extraOptionKey)
+	data, err := base64.StdEncoding.DecodeString(encoded)
+	require.NoError(t, err)
+	decoded, err := DecodeExtraOption(data)
+	require.NoError(t, err)
+	require.Equal(t, opt, decoded)
+}
+
+func TestBuildNydusOverlayMountGolden(t *testing.T) {
+	mounts, err := BuildNydusOverlayMount("/snapshots/1/fs/image/image.boot", "{}", "/snapshots/2", layout.RafsV6,
+		[]string{"workdir=/snapshots/2/work", "upperdir=/snapshots/2/fs", "lowerdir=/snapshots/1/mnt"})
+	require.NoError(t, err)
+	require.Equal(t, []mount.Mount{{
+		Type:   "fuse.nydus-overlayfs",
+		Source: "overlay",
+		Options: []string{
+			"workdir=/snapshots/2/work",
+			"upperdir=/snapshots/2/fs",
+			"lowerdir=/snapshots/1/mnt",
+			"extraoption=eyJzb3VyY2UiOiIvc25hcHNob3RzLzEvZnMvaW1hZ2UvaW1hZ2UuYm9vdCIsImNvbmZpZyI6Int9Iiwic25hcHNob3RkaXIiOiIvc25hcHNob3RzLzIiLCJmc192ZXJzaW9uIjoidjYiLCJzY2hlbWFfdmVyc2lvbiI6MX0=",
+		},
+	}}, mounts)
+
+	_, err = BuildNydusOverlayMount("", "{}", "/snapshots/2", layout.RafsV6, nil)
+	require.Error(t, err)
+	_, err = BuildNydusOverlayMount("/bootstrap", "{}", "/snapshots/2", layout.RafsV6, []string{"extraoption=e30="})
+	require.Error(t, err)
+}
+
+func TestParseExtraOption(t *testing.T) {
+	opt := newExtraOption("/snapshots/1/fs/image/image.boot", fuseConfigContent, "/snapshots/2", layout.RafsV6)
+	for _, format := range []string{config.ExtraOptionFormatBase64JSON, config.ExtraOptionFormatBase64GzipJSON,
+		config.ExtraOptionFormatRawJSON} {
+		mounts, err := buildNydusOverlayMount(opt, []string{"workdir=/work"}, extraOptionEncoding{format: format})
+		require.NoError(t, err)
+		parsed, err := ParseExtraOption(mounts[0].Options[1])
+		require.NoError(t, err)
+		require.Equal(t, opt, parsed)
+	}
+
+	encoded, err := encodeExtraOption(&ExtraOption{Source: "/bootstrap", Snapshotdir: "/snapshots/2"}, "")
+	require.NoError(t, err)
+	_, err = ParseExtraOption(encoded)
+	require.EqualError(t, err, "extra option has empty fields: config, fs_version")
+
+	encoded, err = encodeExtraOption(&ExtraOption{Source: "/bootstrap", Config: "{}", Version: layout.RafsV6}, "")
+	require.NoError(t, err)
+	_, err = ParseExtraOption(encoded)
+	require.EqualError(t, err, "extra option has empty fields: snapshotdir")
+
+	_, err = ParseExtraOption("workdir=/work")
+	require.Error(t, err)
+}
+
+func TestExtraOptionFormat(t *testing.T) {
+	opt := newExtraOption("/snapshots/1/fs/image/image.boot", fuseConfigContent, "/snapshots/2", layout.RafsV6)
+
+	for format, key := range map[string]string{
+		"":                                     extraOptionKey,
+		config.ExtraOptionFormatBase64JSON:     extraOptionKey,
+		config.ExtraOptionFormatRawJSON:        extraOptionRawJSONKey,
+		config.ExtraOptionFormatBase64GzipJSON: extraOptionGzipKey,
+	} {
+		encoded, err := encodeExtraOption(opt, format)
+		require.NoError(t, err)
+		require.True(t, strings.HasPrefix(encoded, key), format)
+		require.True(t, isExtraOption(encoded))
+
+		decoded, err := decodeExtraOption(encoded)
+		require.NoError(t, err)
+		require.Equal(t, opt, decoded)
+	}
+
+	_, err := encodeExtraOption(opt, "cbor")
+	require.Error(t, err)
+
+	_, err = decodeExtraOption("lowerdir=/lower")
+	require.Error(t, err)
+	_, err = decodeExtraOption(extraOptionKey + "!!!")
+	require.Error(t, err)
+	_, err = decodeExtraOption(extraOptionGzipKey + base64.StdEncoding.EncodeToString([]byte("not gzip")))
+	require.Error(t, err)
+}
+
+func TestExtraOptionGzip(t *testing.T) {
+	opt := newExtraOption("/snapshots/1/fs/image/image.boot", fuseConfigContent, "/snapshots/2", layout.RafsV6)
+
+	plain, err := encodeExtraOption(opt, config.ExtraOptionFormatBase64JSON)
+	require.NoError(t, err)
+	compressed, err := encodeExtraOption(opt, config.ExtraOptionFormatBase64GzipJSON)
+	require.NoError(t, err)
+	require.Less(t, len(compressed), len(plain))
+
+	data, format, err := extraOptionPayload(compressed)
+	require.NoError(t, err)
+	require.Equal(t, config.ExtraOptionFormatBase64GzipJSON, format)
+	decoded, err := DecodeExtraOption(data)
+	require.NoError(t, err)
+	require.Equal(t, opt, decoded)
+}
+
+func TestExtraOptionHeader(t *testing.T) {
+	opt := newExtraOption("/snapshots/1/fs/image/image.boot", fuseConfigContent, "/snapshots/2", layout.RafsV6)
+	data, err := json.Marshal(opt)
+	require.NoError(t, err)
+	framed := frameExtraOption(data)
+	encode := func(b []byte) string { return extraOptionKey + base64.StdEncoding.EncodeToString(b) }
+
+	for _, format := range []string{config.ExtraOptionFormatBase64JSON, config.ExtraOptionFormatBase64GzipJSON} {
+		mounts, err := buildNydusOverlayMount(opt, nil, extraOptionEncoding{format: format, header: true})
+		require.NoError(t, err)
+		payload, gotFormat, isFramed, err := decodeExtraOptionPayload(mounts[0].Options[0])
+		require.NoError(t, err)
+		require.True(t, isFramed)
+		require.Equal(t, format, gotFormat)
+		require.Equal(t, data, payload)
+
+		// Framing is kept when the configuration is replaced.
+		updated, err := UpdateMountConfig(mounts[0], fscacheConfigContent)
+		require.NoError(t, err)
+		_, _, isFramed, err = decodeExtraOptionPayload(updated.Options[0])
+		require.NoError(t, err)
+		require.True(t, isFramed)
+	}
+
+	// Legacy payload without the header.
+	decoded, err := decodeExtraOption(encode(data))
+	require.NoError(t, err)
+	require.Equal(t, opt, decoded)
+
+	truncated := [][]byte{framed[:len(framed)-1], framed[:extraOptionHeaderSize-1]}
+	for _, b := range truncated {
+		_, err = decodeExtraOption(encode(b))
+		require.ErrorIs(t, err, ErrCorruptedExtraOption)
+	}
+
+	flipped := append([]byte{}, framed...)
+	flipped[extraOptionHeaderSize+len(data)/2] ^= 0x01
+	_, err = decodeExtraOption(encode(flipped))
+	require.ErrorIs(t, err, ErrCorruptedExtraOption)
+	require.Contains(t, err.Error(), "crc32 mismatch")
+}
+
+func TestFsVersionOption(t *testing.T) {
+	opt := newExtraOption("/bootstrap", "{}", "/snapshots/1", layout.RafsV5)
+	overlayOptions := []string{"workdir=/work", "fs_version=v6", "upperdir=/upper"}
+
+	mounts, err := buildNydusOverlayMount(opt, overlayOptions, extraOptionEncoding{fsVersion: true})
+	require.NoError(t, err)
+	var versions []string
+	for _, o := range mounts[0].Options {
+		if strings.HasPrefix(o, fsVersionOptionKey) {
+			versions = append(versions, o)
+		}
+	}
+	require.Equal(t, []string{"fs_version=v5"}, versions)
+	require.Equal(t, []string{"workdir=/work", "upperdir=/upper"}, mounts[0].Options[:2])
+	_, err = VerifyMountExtraOption(mounts[0])
+	require.NoError(t, err)
+
+	mounts, err = buildNydusOverlayMount(opt, []string{"workdir=/work"}, extraOptionEncoding{})
+	require.NoError(t, err)
+	for _, o := range mounts[0].Options {
+		require.False(t, strings.HasPrefix(o, fsVersionOptionKey))
+	}
+}
+
+func TestExtraOptionChecksum(t *testing.T) {
+	opt := newExtraOption("/bootstrap", "{}", "/snapshots/1", layout.RafsV6)
+	overlayOptions := []string{"workdir=/work", "upperdir=/upper"}
+
+	mounts, err := buildNydusOverlayMount(opt, overlayOptions, extraOptionEncoding{placement: config.ExtraOptionPlacementLast, checksum: true})
+	require.NoError(t, err)
+	options := mounts[0].Options
+	require.Len(t, options, 4)
+	require.True(t, strings.HasPrefix(options[2], extraOptionKey))
+	require.True(t, strings.HasPrefix(options[3], extraOptionChecksumKey))
+
+	data, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(options[2], extraOptionKey))
+	require.NoError(t, err)
+	checksum := strings.TrimPrefix(options[3], extraOptionChecksumKey)
+	require.Equal(t, extraOptionChecksum(data), checksum)
+
+	data[len(data)/2] ^= 0xff
+	require.NotEqual(t, extraOptionChecksum(data), checksum)
+
+	mounts, err = buildNydusOverlayMount(opt, overlayOptions, extraOptionEncoding{placement: config.ExtraOptionPlacementFirst, checksum: true})
+	require.NoError(t, err)
+	require.True(t, strings.HasPrefix(mounts[0].Options[0], extraOptionKey))
+	require.True(t, strings.HasPrefix(mounts[0].Options[1], extraOptionChecksumKey))
+
+	mounts, err = buildNydusOverlayMount(opt, overlayOptions, extraOptionEncoding{})
+	require.NoError(t, err)
+	require.Len(t, mounts[0].Options, 3)
+}
+
+func TestExtraOptionFieldMask(t *testing.T) {
+	opt := newExtraOption("/bootstrap", "{}", "/snapshots/1", layout.RafsV6)
+	decode := func(enc extraOptionEncoding) map[string]interface{} {
+		enc.format = config.ExtraOptionFormatRawJSON
+		mounts, err := buildNydusOverlayMount(opt, nil, enc)
+		require.NoError(t, err)
+		m := map[string]interface{}{}
+		require.NoError(t, json.Unmarshal([]byte(strings.TrimPrefix(mounts[0].Options[0], extraOptionRawJSONKey)), &m))
+		return m
+	}
+
+	full := decode(extraOptionEncoding{})
+	require.Equal(t, map[string]interface{}{
+		"source":         "/bootstrap",
+		"config":         "{}",
+		"snapshotdir":    "/snapshots/1",
+		"fs_version":     "v6",
+		"schema_version": float64(ExtraOptionSchemaVersion),
+	}, full)
+
+	// Required fields can't be masked out.
+	minimal := decode(extraOptionEncoding{fields: []string{"fs_version"}})
+	require.Equal(t, full, minimal)
+
+	opt.MountRetries = 3
+	opt.BackendType = "registry"
+	withRetries := decode(extraOptionEncoding{fields: []string{"mount_retries"}})
+	require.Equal(t, float64(3), withRetries["mount_retries"])
+	require.NotContains(t, withRetries, "backend_type")
+
+	// A masked mount still parses and verifies.
+	for _, fields := range [][]string{{"fs_version"}, {"source"}, {"mount_retries"}} {
+		mounts, err := buildNydusOverlayMount(opt, nil, extraOptionEncoding{fields: fields})
+		require.NoError(t, err)
+		parsed, err := ParseExtraOption(mounts[0].Options[0])
+		require.NoError(t, err)
+		require.Equal(t, opt.Source, parsed.Source)
+		require.Equal(t, opt.Config, parsed.Config)
+		require.Equal(t, opt.Snapshotdir, parsed.Snapshotdir)
+		require.Empty(t, parsed.BackendType)
+		_, err = VerifyMountExtraOption(mounts[0])
+		require.NoError(t, err)
+	}
+
+	_, err := buildNydusOverlayMount(opt, nil, extraOptionEncoding{fields: []string{"password"}})
+	require.Error(t, err)
+}
+
+func TestExtraOptionFieldNames(t *testing.T) {
+	typ := reflect.TypeOf(ExtraOption{})
+	tags := make([]string, 0, typ.NumField())
+	for i := 0; i < typ.NumField(); i++ {
+		tags = append(tags, strings.Split(typ.Field(i).Tag.Get("json"), ",")[0])
+	}
+	require.ElementsMatch(t, tags, config.ExtraOptionFieldNames)
+}
+
+func TestUpdateMountConfig(t *testing.T) {
+	opt := newExtraOption("/snapshots/1/fs/image/image.boot", fuseConfigContent, "/snapshots/2", layout.RafsV6)
+	opt.BackendType = "registry"
+	overlayOptions := []string{"workdir=/work", "upperdir=/upper"}
+
+	for _, format := range []string{config.ExtraOptionFormatBase64JSON, config.ExtraOptionFormatBase64GzipJSON,
+		config.ExtraOptionFormatRawJSON} {
+		mounts, err := buildNydusOverlayMount(opt, overlayOptions, extraOptionEncoding{format: format, checksum: true})
+		require.NoError(t, err)
+
+		updated, err := UpdateMountConfig(mounts[0], fscacheConfigContent)
+		require.NoError(t, err)
+		require.Equal(t, mounts[0].Type, updated.Type)
+		require.Equal(t, mounts[0].Source, updated.Source)
+		require.Equal(t, overlayOptions, updated.Options[:2])
+		require.NotEqual(t, mounts[0].Options[2], updated.Options[2])
+
+		decoded, err := decodeExtraOption(updated.Options[2])
+		require.NoError(t, err)
+		expected := *opt
+		expected.Config = fscacheConfigContent
+		require.Equal(t, &expected, decoded)
+
+		data, gotFormat, err := extraOptionPayload(updated.Options[2])
+		require.NoError(t, err)
+		require.Equal(t, format, gotFormat)
+		require.Equal(t, extraOptionChecksumKey+extraOptionChecksum(data), updated.Options[3])
+
+		// The original mount is left untouched.
+		decoded, err = decodeExtraOption(mounts[0].Options[2])
+		require.NoError(t, err)
+		require.Equal(t, opt, decoded)
+	}
+
+	_, err := UpdateMountConfig(mount.Mount{Type: "overlay", Options: overlayOptions}, fscacheConfigContent)
+	require.Error(t, err)
+}
+
+func TestFuseSubtype(t *testing.T) {
+	opt := newExtraOption("/bootstrap", "{}", "/snapshots/1", layout.RafsV6)
+
+	mounts, err := buildNydusOverlayMount(opt, nil, extraOptionEncoding{})
+	require.NoError(t, err)
+	require.Equal(t, "fuse.nydus-overlayfs", mounts[0].Type)
+
+	mounts, err = buildNydusOverlayMount(opt, nil, extraOptionEncoding{subtype: "nydus-overlayfs-batch"})
+	require.NoError(t, err)
+	require.Equal(t, "fuse.nydus-overlayfs-batch", mounts[0].Type)
+}
+
+func TestVerifyMountExtraOption(t *testing.T) {
+	opt := newExtraOption("/bootstrap", fuseConfigContent, "/snapshots/1", layout.RafsV6)
+	mounts, err := buildNydusOverlayMount(opt, []string{"workdir=/work"}, extraOptionEncoding{})
+	require.NoError(t, err)
+	verified, err := VerifyMountExtraOption(mounts[0])
+	require.NoError(t, err)
+	require.Equal(t, opt, verified)
+
+	encode := func(e *ExtraOption) string {
+		encoded, err := encodeExtraOption(e, "")
+		require.NoError(t, err)
+		return encoded
+	}
+	unknownVersion := *opt
+	unknownVersion.Version = "v100"
+	missingSource := *opt
+	missingSource.Source = ""
+
+	for name, options := range map[string][]string{
+		"no extra option":  {"workdir=/work"},
+		"duplicated":       {mounts[0].Options[1], mounts[0].Options[1]},
+		"bad base64":       {extraOptionKey + "!!!"},
+		"bad json":         {extraOptionKey + base64.StdEncoding.EncodeToString([]byte("{"))},
+		"missing field":    {encode(&missingSource)},
+		"unknown version":  {encode(&unknownVersion)},
+		"truncated base64": {mounts[0].Options[1][:len(mounts[0].Options[1])/2]},
+	} {
+		_, err := VerifyMountExtraOption(mount.Mount{Type: "fuse.nydus-overlayfs", Options: options})
+		require.Error(t, err, name)
+	}
+}
+
+// Serialize the `ExtraOption` into a mount option tagged with the format.
+func encodeExtraOption(extraOption *ExtraOption, format string) (string, error) {
+	no, err := json.Marshal(extraOption)
+	if err != nil {
+		return "", err
+	}
+
+	return formatExtraOption(no, format)
+}
+
+func TestMountRequiresOverlayFsHelper(t *testing.T) {
+	opt := newExtraOption("/bootstrap", "{}", "/snapshots/1", layout.RafsV6)
+	mounts, err := buildNydusOverlayMount(opt, []string{"workdir=/work"}, extraOptionEncoding{})
+	require.NoError(t, err)
+	require.True(t, MountRequiresOverlayFsHelper(mounts[0]))
+
+	require.False(t, MountRequiresOverlayFsHelper(overlayMount([]string{"workdir=/work"})[0]))
+	require.False(t, MountRequiresOverlayFsHelper(mount.Mount{Type: "fuse.other", Options: []string{"ro"}}))
+
+	dir := t.TempDir()
+	t.Setenv("PATH", dir)
+	require.Error(t, checkOverlayFsHelper(""))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "nydus-overlayfs"), []byte("#!/bin/sh\n"), 0755))
+	require.NoError(t, checkOverlayFsHelper(""))
+}
+
+func TestMergeOverlayFlags(t *testing.T) {
+	overlayOptions := []string{"workdir=/work", "upperdir=/upper", "redirect_dir=off"}
+	require.Equal(t, overlayOptions, mergeOverlayFlags(overlayOptions, nil))
+
+	merged := mergeOverlayFlags(overlayOptions, []string{"metacopy=on", "redirect_dir=on"})
+	require.Equal(t, []string{"workdir=/work", "upperdir=/upper", "redirect_dir=off", "metacopy=on"}, merged)
+	require.Len(t, overlayOptions, 3)
+
+	opt := newExtraOption("/bootstrap", "{}", "/snapshots/1", layout.RafsV6)
+	mounts, err := buildNydusOverlayMount(opt, merged, extraOptionEncoding{})
+	require.NoError(t, err)
+	require.Equal(t, "metacopy=on", mounts[0].Options[3])
+	require.True(t, isExtraOption(mounts[0].Options[4]))
+}
+
+func TestSiblingExtraOptions(t *testing.T) {
+	require.Empty(t, siblingExtraOptions(&config.SnapshotConfig{}))
+	require.Empty(t, siblingExtraOptions(&config.SnapshotConfig{ExtraOptionFormat: config.ExtraOptionFormatBase64JSON}))
+	require.Equal(t, []string{"extraoption_gz", "extraoption_checksum", "fs_version"}, siblingExtraOptions(&config.SnapshotConfig{
+		ExtraOptionFormat:       config.ExtraOptionFormatBase64GzipJSON,
+		EmitExtraOptionChecksum: true,
+		EmitFsVersionOption:     true,
+	}))
+}
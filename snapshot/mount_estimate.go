@@ -0,0 +1,69 @@
+/*
+ * Copyright (c) 2023. Nydus Developers. All rights reserved.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package snapshot
+
+import (
+	"os"
+
+	"github.com/pkg/errors"
+
+	"github.com/containerd/nydus-snapshotter/config/daemonconfig"
+	"github.com/containerd/nydus-snapshotter/pkg/daemon"
+	"github.com/containerd/nydus-snapshotter/pkg/layout"
+)
+
+// Page cache working set assumed for serving reads of a mounted image, irrespective
+// of the prefetch buffers. It's a rough figure for capacity planning only.
+const estimatedReadWorkingSet = 32 << 20
+
+// Estimated guest memory overhead of mounting a nydus image, for sizing the VM.
+type GuestMemoryEstimate struct {
+	// Bytes of RAFS metadata resident in memory
+	MetadataBytes int64
+	// Bytes of page cache and prefetch buffers serving reads
+	CacheBytes int64
+}
+
+func (e GuestMemoryEstimate) Total() int64 {
+	return e.MetadataBytes + e.CacheBytes
+}
+
+// Estimate the guest memory needed to mount the RAFS instance with the extra option.
+// RAFS v5 loads the whole bootstrap and builds inode tables on top of it, taking about
+// twice its size, while RAFS v6 metadata is only paged in. Enabled prefetch adds a
+// buffer per prefetch thread.
+func EstimateGuestMemory(rafs *daemon.Rafs, opt *ExtraOption) (*GuestMemoryEstimate, error) {
+	if rafs == nil || opt == nil {
+		return nil, errors.New("estimate guest memory without RAFS instance or extra option")
+	}
+
+	st, err := os.Stat(opt.Source)
+	if err != nil {
+		return nil, errors.Wrapf(err, "stat bootstrap %s", opt.Source)
+	}
+	estimate := GuestMemoryEstimate{MetadataBytes: st.Size(), CacheBytes: estimatedReadWorkingSet}
+	if opt.Version == layout.RafsV5 {
+		estimate.MetadataBytes *= 2
+	}
+
+	c, err := opt.ParseConfig(rafs.GetFsDriver())
+	if err != nil {
+		return nil, errors.Wrapf(err, "parse configuration of snapshot %s", rafs.SnapshotID)
+	}
+	switch cfg := c.(type) {
+	case *daemonconfig.FuseDaemonConfig:
+		if cfg.FSPrefetch.Enable {
+			estimate.CacheBytes += int64(cfg.FSPrefetch.ThreadsCount) * int64(cfg.FSPrefetch.MergingSize)
+		}
+	case *daemonconfig.FscacheDaemonConfig:
+		if prefetch := cfg.Config.BlobPrefetchConfig; prefetch.Enable {
+			estimate.CacheBytes += int64(prefetch.ThreadsCount) * int64(prefetch.MergingSize)
+		}
+	}
+
+	return &estimate, nil
+}
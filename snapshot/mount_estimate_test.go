@@ -0,0 +1,51 @@
+/*
+ * Copyright (c) 2023. Nydus Developers. All rights reserved.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package snapshot
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/containerd/nydus-snapshotter/config"
+	"github.com/containerd/nydus-snapshotter/pkg/daemon"
+	"github.com/containerd/nydus-snapshotter/pkg/layout"
+)
+
+func TestEstimateGuestMemory(t *testing.T) {
+	bootstrap := filepath.Join(t.TempDir(), "image.boot")
+	require.NoError(t, os.WriteFile(bootstrap, make([]byte, 1<<20), 0644))
+	rafs := &daemon.Rafs{SnapshotID: "1", FsDriver: config.FsDriverFusedev}
+
+	opt := newExtraOption(bootstrap, fuseConfigContent, "/snapshots/2", layout.RafsV6)
+	estimate, err := EstimateGuestMemory(rafs, opt)
+	require.NoError(t, err)
+	require.Equal(t, GuestMemoryEstimate{MetadataBytes: 1 << 20, CacheBytes: estimatedReadWorkingSet}, *estimate)
+	require.Equal(t, int64(1<<20+estimatedReadWorkingSet), estimate.Total())
+
+	// RAFS v5 keeps its metadata in memory, prefetch adds buffers.
+	prefetch := strings.Replace(fuseConfigContent, `"mode": "direct"`,
+		`"mode": "direct", "fs_prefetch": {"enable": true, "threads_count": 4, "merging_size": 131072}`, 1)
+	opt = newExtraOption(bootstrap, prefetch, "/snapshots/2", layout.RafsV5)
+	estimate, err = EstimateGuestMemory(rafs, opt)
+	require.NoError(t, err)
+	require.Equal(t, int64(2<<20), estimate.MetadataBytes)
+	require.Equal(t, int64(estimatedReadWorkingSet+4*131072), estimate.CacheBytes)
+
+	opt = newExtraOption(bootstrap, fscacheConfigContent, "/snapshots/2", layout.RafsV6)
+	estimate, err = EstimateGuestMemory(&daemon.Rafs{SnapshotID: "1", FsDriver: config.FsDriverFscache}, opt)
+	require.NoError(t, err)
+	require.Equal(t, int64(1<<20), estimate.MetadataBytes)
+
+	_, err = EstimateGuestMemory(rafs, newExtraOption(filepath.Join(t.TempDir(), "missing"), fuseConfigContent, "/snapshots/2", layout.RafsV6))
+	require.Error(t, err)
+	_, err = EstimateGuestMemory(nil, opt)
+	require.Error(t, err)
+}
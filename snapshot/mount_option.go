@@ -0,0 +1,736 @@
+/*
+ * Copyright (c) 2023. Nydus Developers. All rights reserved.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package snapshot
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	specs "github.com/opencontainers/runtime-spec/specs-go"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+
+	"github.com/containerd/containerd/log"
+	"github.com/containerd/containerd/mount"
+	"github.com/containerd/containerd/snapshots/storage"
+
+	"github.com/containerd/nydus-snapshotter/config/daemonconfig"
+	"github.com/containerd/nydus-snapshotter/internal/constant"
+	"github.com/containerd/nydus-snapshotter/pkg/daemon"
+	"github.com/containerd/nydus-snapshotter/pkg/daemon/types"
+	"github.com/containerd/nydus-snapshotter/pkg/errdefs"
+	"github.com/containerd/nydus-snapshotter/pkg/layout"
+	"github.com/containerd/nydus-snapshotter/pkg/metrics/collector"
+	"github.com/containerd/nydus-snapshotter/pkg/metrics/data"
+	"github.com/containerd/nydus-snapshotter/pkg/metrics/tool"
+	"github.com/containerd/nydus-snapshotter/pkg/utils/file"
+)
+
+// `ExtraOption.Config` refers to a file in the snapshot directory with this prefix
+// rather than embedding the configuration content.
+const (
+	extraOptionConfigFileRef  = "@file:"
+	extraOptionConfigFileName = "extraoption-config.json"
+)
+
+// Versions of the `extraoption` wire format. Payloads emitted before the schema
+// version was introduced don't carry the field and are decoded as v0.
+const (
+	ExtraOptionSchemaV0 = 0
+	ExtraOptionSchemaV1 = 1
+
+	ExtraOptionSchemaVersion = ExtraOptionSchemaV1
+)
+
+type ExtraOption struct {
+	Source        string `json:"source"`
+	Config        string `json:"config"`
+	Snapshotdir   string `json:"snapshotdir"`
+	Version       string `json:"fs_version"`
+	SchemaVersion int    `json:"schema_version,omitempty"`
+	// Non-secret summary of the storage backend, only filled when enabled
+	BackendType   string `json:"backend_type,omitempty"`
+	MirrorCount   int    `json:"mirror_count,omitempty"`
+	PrimaryMirror string `json:"primary_mirror,omitempty"`
+	// Hint of how many times the guest agent retries a failed mount
+	MountRetries int `json:"mount_retries,omitempty"`
+}
+
+func newExtraOption(source, config, snapshotDir, version string) *ExtraOption {
+	return &ExtraOption{
+		Source:        source,
+		Config:        config,
+		Snapshotdir:   snapshotDir,
+		Version:       version,
+		SchemaVersion: ExtraOptionSchemaVersion,
+	}
+}
+
+// Fields nydus-overlayfs can't mount without, which must not be empty nor masked out.
+var extraOptionRequiredFields = []string{"source", "config", "snapshotdir", "fs_version"}
+
+// Check all required fields at once, so that operators can fix them in one go.
+func (e *ExtraOption) Validate() error {
+	values := map[string]string{
+		"source":      e.Source,
+		"config":      e.Config,
+		"snapshotdir": e.Snapshotdir,
+		"fs_version":  e.Version,
+	}
+	var empty []string
+	for _, f := range extraOptionRequiredFields {
+		if values[f] == "" {
+			empty = append(empty, f)
+		}
+	}
+
+	if len(empty) > 0 {
+		return errors.Errorf("extra option has empty fields: %s", strings.Join(empty, ", "))
+	}
+	if e.MountRetries < 0 {
+		return errors.Errorf("invalid mount retries %d", e.MountRetries)
+	}
+
+	return nil
+}
+
+// Summarize the storage backend of the daemon configuration without any secret.
+func (e *ExtraOption) fillBackendSummary(c daemonconfig.DaemonConfig) {
+	backendType, backend := c.StorageBackend()
+	e.BackendType = backendType
+	if backend == nil {
+		return
+	}
+	e.MirrorCount = len(backend.Mirrors)
+	if len(backend.Mirrors) > 0 {
+		e.PrimaryMirror = stripUserinfo(backend.Mirrors[0].Host)
+	}
+}
+
+// Get the daemon configuration content, reading it from the referred file if the
+// configuration is not embedded. Only configuration files written by the snapshotter
+// are resolved, as a decoded extra option may come from anywhere.
+func (e ExtraOption) ConfigContent() (string, error) {
+	if !strings.HasPrefix(e.Config, extraOptionConfigFileRef) {
+		return e.Config, nil
+	}
+	path := strings.TrimPrefix(e.Config, extraOptionConfigFileRef)
+	if !filepath.IsAbs(path) || filepath.Base(path) != extraOptionConfigFileName {
+		return "", errors.Wrapf(errdefs.ErrInvalidArgument, "configuration file reference %s", path)
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return "", errors.Wrapf(err, "read configuration file %s", path)
+	}
+	return string(b), nil
+}
+
+// Rebuild the daemon configuration object from the embedded configuration content,
+// so consumers can inspect backends and mirrors without parsing json by hand.
+func (e ExtraOption) ParseConfig(fsDriver string) (daemonconfig.DaemonConfig, error) {
+	content, err := e.ConfigContent()
+	if err != nil {
+		return nil, err
+	}
+	return daemonconfig.ParseDaemonConfig(fsDriver, []byte(content))
+}
+
+// Tell whether the mount fetches blobs from the remote backend on demand rather than
+// having all data in place, i.e. not backed by local files nor prefetching everything.
+func (e ExtraOption) IsOnDemand(fsDriver string) (bool, error) {
+	c, err := e.ParseConfig(fsDriver)
+	if err != nil {
+		return false, err
+	}
+	if backendType, _ := c.StorageBackend(); backendType == "localfs" {
+		return false, nil
+	}
+	if cfg, ok := c.(*daemonconfig.FuseDaemonConfig); ok && cfg.FSPrefetch.Enable && cfg.FSPrefetch.PrefetchAll {
+		return false, nil
+	}
+
+	return true, nil
+}
+
+// Write the daemon configuration to a file in the snapshot directory and return
+// the reference to put in `ExtraOption.Config` instead of the content.
+func writeExtraOptionConfigFile(snapshotDir, content string) (string, error) {
+	path := filepath.Join(snapshotDir, extraOptionConfigFileName)
+	if err := file.WriteFileAtomic(path, []byte(content), 0600); err != nil {
+		return "", errors.Wrapf(err, "write extra option configuration file")
+	}
+	return extraOptionConfigFileRef + path, nil
+}
+
+// Returned when the RAFS instance or its daemon is not ready yet, callers may retry later.
+var ErrMountNotReady = errors.New("mount not ready")
+
+// Return the storage backend endpoints the mount depends on, i.e. registry host
+// and mirrors or OSS endpoint and bucket, with any credentials stripped.
+func (e ExtraOption) ReferencedBackends(fsDriver string) ([]string, error) {
+	c, err := e.ParseConfig(fsDriver)
+	if err != nil {
+		return nil, err
+	}
+	backendType, backend := c.StorageBackend()
+	if backend == nil {
+		return nil, nil
+	}
+
+	var endpoints []string
+	add := func(endpoint string) {
+		endpoint = stripUserinfo(endpoint)
+		if endpoint == "" {
+			return
+		}
+		for _, e := range endpoints {
+			if e == endpoint {
+				return
+			}
+		}
+		endpoints = append(endpoints, endpoint)
+	}
+
+	switch backendType {
+	case "oss":
+		add(strings.TrimSuffix(backend.EndPoint, "/") + "/" + backend.BucketName)
+	default:
+		add(backend.Host)
+		for _, m := range backend.Mirrors {
+			add(m.Host)
+		}
+	}
+
+	return endpoints, nil
+}
+
+// Return a concise one-line description of the extra option for events and
+// logs. The daemon configuration is deliberately left out as it may carry
+// registry or storage credentials.
+func (e ExtraOption) Summary() string {
+	parts := []string{"fs_version=" + e.Version}
+	if e.BackendType != "" {
+		parts = append(parts, "backend="+e.BackendType)
+	}
+	if e.MirrorCount > 0 {
+		parts = append(parts, fmt.Sprintf("mirrors=%d", e.MirrorCount))
+	}
+	return strings.Join(parts, " ")
+}
+
+// Stages of building a remote mount where a MountError may happen
+const (
+	MountStageOptions     = "options"
+	MountStageRafs        = "rafs"
+	MountStageBootstrap   = "bootstrap"
+	MountStageDaemon      = "daemon"
+	MountStageConfig      = "config"
+	MountStageFsVersion   = "fs_version"
+	MountStageExtraOption = "extra_option"
+)
+
+// Outcomes of building a remote mount other than failing at a stage
+const (
+	MountOutcomeSuccess = "success"
+	// No bootstrap and fall back to a plain overlay mount
+	MountOutcomeOverlayFallback = "overlay_fallback"
+)
+
+func init() {
+	collector.SetLabelSanitizer(data.MountOutcomeLabel, collector.AllowlistSanitizer(
+		MountOutcomeSuccess, MountOutcomeOverlayFallback,
+		MountStageOptions, MountStageRafs, MountStageBootstrap, MountStageDaemon,
+		MountStageConfig, MountStageFsVersion, MountStageExtraOption))
+}
+
+// Failure of building a remote mount with the context where it happens,
+// which callers can extract by `errors.As`.
+type MountError struct {
+	SnapshotID string
+	// Empty if the daemon is not known yet
+	DaemonID string
+	Stage    string
+	Err      error
+}
+
+func newMountError(snapshotID, daemonID, stage string, err error) *MountError {
+	return &MountError{SnapshotID: snapshotID, DaemonID: daemonID, Stage: stage, Err: err}
+}
+
+func (e *MountError) Error() string {
+	if e.DaemonID == "" {
+		return fmt.Sprintf("remoteMounts: snapshot %s, stage %s: %v", e.SnapshotID, e.Stage, e.Err)
+	}
+	return fmt.Sprintf("remoteMounts: snapshot %s, daemon %s, stage %s: %v", e.SnapshotID, e.DaemonID, e.Stage, e.Err)
+}
+
+func (e *MountError) Unwrap() error {
+	return e.Err
+}
+
+// Transform the assembled mounts before returning them to containerd,
+// e.g. to inject site-specific options.
+type MountPostProcessor func([]mount.Mount) ([]mount.Mount, error)
+
+// Post-process the remote mounts returned by the snapshotter, nil to disable.
+func WithMountPostProcessor(p MountPostProcessor) NewSnapshotterOpt {
+	return func(s *snapshotter) error {
+		s.mountPostProcessor = p
+		return nil
+	}
+}
+
+func (o *snapshotter) remoteMountWithExtraOptions(ctx context.Context, s storage.Snapshot, id string, overlayOptions []string) ([]mount.Mount, error) {
+	mounts, _, err := o.BuildRemoteMountWithOption(ctx, s, id, overlayOptions)
+	if err == nil && o.checks.helperMissing {
+		for _, m := range mounts {
+			if MountRequiresOverlayFsHelper(m) {
+				log.G(ctx).Warnf("returning %s mount for snapshot %s while its mount helper is not found", m.Type, id)
+			}
+		}
+	}
+	if err != nil || o.mountPostProcessor == nil {
+		return mounts, err
+	}
+
+	mounts, err = o.mountPostProcessor(mounts)
+	if err != nil {
+		return nil, errors.Wrapf(err, "post-process mounts")
+	}
+	return mounts, nil
+}
+
+// Builds remote mounts without going through containerd, implemented by the snapshotter
+// returned by `NewSnapshotter`. Consumers get it with a type assertion, e.g.
+// `sn.(snapshot.RemoteMountBuilder)`.
+type RemoteMountBuilder interface {
+	BuildRemoteMountWithOption(ctx context.Context, s storage.Snapshot, id string, overlayOptions []string) ([]mount.Mount, *ExtraOption, error)
+	BuildRemoteMounts(ctx context.Context, requests []MountRequest) ([]MountResult, error)
+}
+
+// Build the nydus-overlayfs mount slice along with the `ExtraOption` encoded in it,
+// so callers can reuse it without decoding the mount options again.
+// The returned `ExtraOption` is nil if a plain overlay mount is built.
+func (o *snapshotter) BuildRemoteMountWithOption(ctx context.Context, s storage.Snapshot, id string, overlayOptions []string) ([]mount.Mount, *ExtraOption, error) {
+	return o.buildRemoteMount(ctx, s, id, overlayOptions)
+}
+
+// A request to build the remote mount of a snapshot in batch
+type MountRequest struct {
+	Snapshot       storage.Snapshot
+	ID             string
+	OverlayOptions []string
+}
+
+type MountResult struct {
+	Mounts      []mount.Mount
+	ExtraOption *ExtraOption
+	Err         error
+}
+
+// Build remote mounts for many snapshots at once. Instance configurations are cached
+// by the snapshotter whether built in batch or not, and nothing else is shared among
+// snapshots. Failures are reported per request, the returned error is only set if the
+// requests are invalid or the batch is interrupted by the context.
+func (o *snapshotter) BuildRemoteMounts(ctx context.Context, requests []MountRequest) ([]MountResult, error) {
+	if err := checkDuplicatedRequests(requests); err != nil {
+		return nil, err
+	}
+
+	results := make([]MountResult, 0, len(requests))
+	for _, r := range requests {
+		if err := ctx.Err(); err != nil {
+			return results, err
+		}
+		mounts, extraOption, err := o.buildRemoteMount(ctx, r.Snapshot, r.ID, r.OverlayOptions)
+		results = append(results, MountResult{Mounts: mounts, ExtraOption: extraOption, Err: err})
+	}
+
+	return results, nil
+}
+
+// Requests for the same snapshot in a batch are a caller bug.
+func checkDuplicatedRequests(requests []MountRequest) error {
+	seen := make(map[string]int, len(requests))
+	var duplicated []string
+	for _, r := range requests {
+		if seen[r.ID]++; seen[r.ID] == 2 {
+			duplicated = append(duplicated, r.ID)
+		}
+	}
+	if len(duplicated) > 0 {
+		return errors.Wrapf(errdefs.ErrInvalidArgument, "duplicated snapshots %s in mount requests",
+			strings.Join(duplicated, ", "))
+	}
+
+	return nil
+}
+
+// Key identifying the mount built for a snapshot, for consumers caching the encoded
+// mounts. It changes whenever any input of the mount, e.g. the daemon configuration,
+// the overlay options or the filesystem version, changes.
+func MountCacheKey(id string, opt ExtraOption, overlayOptions []string) string {
+	// JSON keeps the fields apart, so that e.g. ["a,b"] and ["a", "b"] differ.
+	data, _ := json.Marshal(struct {
+		ID             string      `json:"id"`
+		ExtraOption    ExtraOption `json:"extra_option"`
+		OverlayOptions []string    `json:"overlay_options"`
+	}{id, opt, overlayOptions})
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// Load the configuration the daemon serves the snapshot with and its marshaled content.
+// A shared daemon has a configuration file per instance under the directory of `owner`,
+// the daemon the instance is attached to, which is not `d` when failed over. The file
+// may not have been written yet while recovering, fall back to the daemon configuration then.
+func (o *snapshotter) loadDaemonConfig(ctx context.Context, d, owner *daemon.Daemon,
+	snapshotID string) (daemonconfig.DaemonConfig, string, error) {
+	loadDaemonConfig := func() (daemonconfig.DaemonConfig, error) {
+		return d.Config, nil
+	}
+	if !d.IsSharedDaemon() {
+		return dumpConfig(loadDaemonConfig)
+	}
+
+	configFile := owner.ConfigFile(snapshotID)
+	if _, err := os.Stat(configFile); os.IsNotExist(err) {
+		if err := checkFallbackConfig(d.Config); err != nil {
+			return nil, "", errors.Wrapf(ErrMountNotReady, "configuration file %s of snapshot %s doesn't exist: %s",
+				configFile, snapshotID, err)
+		}
+		log.G(ctx).Warnf("configuration file %s of snapshot %s doesn't exist, fall back to daemon %s configuration",
+			configFile, snapshotID, d.ID())
+		return dumpConfig(loadDaemonConfig)
+	}
+
+	// The configuration written for the failed daemon always predates the one taking over.
+	if o.checks.staleConfig && owner == d {
+		if startTime, err := tool.GetProcessStartTime(d.Pid()); err != nil {
+			log.G(ctx).WithError(err).Warnf("get start time of daemon %s", d.ID())
+		} else if err := checkStaleConfig(configFile, startTime); err != nil {
+			log.G(ctx).Warn(err)
+		}
+	}
+	return o.configCache.load(owner.ID(), snapshotID, configFile, func() (daemonconfig.DaemonConfig, error) {
+		cfg, err := loadInstanceConfig(d.States.FsDriver, configFile)
+		return cfg, errors.Wrapf(err, "Failed to load instance configuration %s", configFile)
+	})
+}
+
+// The daemon keeping the instance configuration of a shared daemon, which is the
+// primary one if it's still known after failing over to `d`. A destroyed daemon
+// has its configuration directory removed along with it.
+func (o *snapshotter) configOwner(d *daemon.Daemon, primaryID string) *daemon.Daemon {
+	if d.ID() == primaryID || !d.IsSharedDaemon() {
+		return d
+	}
+	if primary, err := o.fs.GetDaemonByID(primaryID); err == nil {
+		return primary
+	}
+	return d
+}
+
+// Detect the filesystem version of the bootstrap under a deadline, since reading a
+// bootstrap on a stalled storage blocks forever. The blocked read can't be aborted,
+// it's left behind to finish on its own.
+func detectFsVersionWithTimeout(ctx context.Context, source string, timeout time.Duration,
+	detect func(string) (string, error)) (string, error) {
+	if timeout <= 0 {
+		timeout = constant.DefaultBootstrapReadTimeoutSecs * time.Second
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	type result struct {
+		version string
+		err     error
+	}
+	ch := make(chan result, 1)
+	go func() {
+		version, err := detect(source)
+		ch <- result{version: version, err: err}
+	}()
+
+	select {
+	case r := <-ch:
+		return r.version, r.err
+	case <-ctx.Done():
+		return "", errors.Wrapf(ctx.Err(), "read bootstrap %s", source)
+	}
+}
+
+// Detect the filesystem version of the bootstrap, falling back to the configured
+// version if the bootstrap header is not recognized.
+func (o *snapshotter) bootstrapVersion(ctx context.Context, source string) (string, error) {
+	version, err := detectFsVersionWithTimeout(ctx, source, o.policy.bootstrapTimeout, layout.DetectFsVersionFromFile)
+	if err == nil {
+		return version, nil
+	}
+	if !errors.Is(err, layout.ErrUnknownFsVersion) || o.policy.fallbackFsVersion == "" {
+		return "", err
+	}
+
+	log.G(ctx).WithError(err).Errorf("failed to detect filesystem version of bootstrap %s, "+
+		"fall back to version %s, the mount may not work", source, o.policy.fallbackFsVersion)
+	return o.policy.fallbackFsVersion, nil
+}
+
+func (o *snapshotter) buildRemoteMount(ctx context.Context, s storage.Snapshot, id string,
+	overlayOptions []string) ([]mount.Mount, *ExtraOption, error) {
+	mounts, extraOption, err := o.assembleRemoteMount(ctx, s, id, overlayOptions)
+
+	outcome, version := MountOutcomeSuccess, ""
+	var mountErr *MountError
+	switch {
+	case errors.As(err, &mountErr):
+		outcome = mountErr.Stage
+	case err != nil:
+		outcome = collector.OtherLabelValue
+	case extraOption == nil:
+		outcome = MountOutcomeOverlayFallback
+	default:
+		version = extraOption.Version
+	}
+	collector.CollectRemoteMountOutcome(outcome, version)
+
+	return mounts, extraOption, err
+}
+
+func (o *snapshotter) assembleRemoteMount(ctx context.Context, s storage.Snapshot, id string,
+	overlayOptions []string) ([]mount.Mount, *ExtraOption, error) {
+	if err := checkOptionLength(overlayOptions, o.checks.maxOptionLength); err != nil {
+		return nil, nil, newMountError(id, "", MountStageOptions, err)
+	}
+	// Fail before any I/O rather than when packing the extra option.
+	if err := checkNoExtraOption(overlayOptions); err != nil {
+		return nil, nil, newMountError(id, "", MountStageOptions, err)
+	}
+
+	instance := daemon.RafsSet.Get(id)
+	if instance == nil {
+		return nil, nil, newMountError(id, "", MountStageRafs, errors.Wrapf(ErrMountNotReady, "rafs instance %s", id))
+	}
+	// The per-instance configuration is located by the instance's snapshot ID, so
+	// a mismatched instance would load the configuration of another snapshot.
+	if instance.SnapshotID != id {
+		return nil, nil, newMountError(id, instance.DaemonID, MountStageRafs,
+			errors.Errorf("rafs instance of snapshot %s is registered for snapshot %s", instance.SnapshotID, id))
+	}
+
+	source, err := o.fs.BootstrapFile(id)
+	if err != nil {
+		// An empty nydus layer legitimately has no bootstrap, nothing to pass to nydus-overlayfs.
+		if errdefs.IsNotFound(err) && o.policy.allowEmptyBootstrap {
+			log.G(ctx).Warnf("snapshot %s has no bootstrap, fall back to plain overlay mount", id)
+			return overlayMount(overlayOptions), nil, nil
+		}
+		return nil, nil, newMountError(id, instance.DaemonID, MountStageBootstrap, err)
+	}
+	if o.checks.parentBootstraps {
+		if err := checkParentBootstraps(s.ParentIDs); err != nil {
+			return nil, nil, newMountError(id, instance.DaemonID, MountStageBootstrap, err)
+		}
+	}
+
+	daemon, err := selectDaemon(ctx, instance.DaemonID, o.policy.fallbackDaemonIDs, o.fs.GetDaemonByID)
+	if err != nil {
+		if errdefs.IsNotFound(err) {
+			err = ErrMountNotReady
+		}
+		return nil, nil, newMountError(id, instance.DaemonID, MountStageDaemon,
+			errors.Wrapf(err, "get daemon with ID %s", instance.DaemonID))
+	}
+	if daemonStarting(daemon) {
+		return nil, nil, newMountError(id, daemon.ID(), MountStageDaemon,
+			errors.Wrapf(ErrMountNotReady, "daemon %s is starting", daemon.ID()))
+	}
+
+	owner := o.configOwner(daemon, instance.DaemonID)
+	c, configContent, err := o.loadDaemonConfig(ctx, daemon, owner, instance.SnapshotID)
+	if err != nil {
+		return nil, nil, newMountError(id, daemon.ID(), MountStageConfig, err)
+	}
+	// The limit is on the configuration embedded in the extra option, not on the one
+	// referred to by file, which exists for configurations too large to embed.
+	if !o.encoding.configByFile {
+		if err := checkConfigSize(configContent, o.encoding.maxConfigSize); err != nil {
+			return nil, nil, newMountError(id, daemon.ID(), MountStageConfig, err)
+		}
+	}
+	if err := checkBackendAllowed(c, o.policy.allowedBackends); err != nil {
+		return nil, nil, newMountError(id, daemon.ID(), MountStageConfig, err)
+	}
+	if o.checks.configVersion {
+		if err := checkConfigFileVersion(daemonConfigFile(owner, instance.SnapshotID), daemon); err != nil {
+			log.G(ctx).WithError(err).Warnf("daemon configuration may be incompatible with nydusd")
+		}
+	}
+	if o.checks.cacheDir != "" {
+		if err := checkCacheDir(ctx, cacheWorkDir(c), o.checks.cacheDir); err != nil {
+			return nil, nil, newMountError(id, daemon.ID(), MountStageConfig, err)
+		}
+	}
+
+	// get version from bootstrap
+	version, err := o.bootstrapVersion(ctx, source)
+	if err != nil {
+		return nil, nil, newMountError(id, daemon.ID(), MountStageFsVersion, err)
+	}
+
+	// when enable nydus-overlayfs, return unified mount slice for runc and kata
+	extraOption := newExtraOption(source, configContent, o.snapshotDir(s.ID), version)
+	extraOption.MountRetries = o.encoding.mountRetries
+	if err := extraOption.Validate(); err != nil {
+		return nil, nil, newMountError(id, daemon.ID(), MountStageExtraOption, err)
+	}
+	if o.checks.bootstrapPath {
+		if err := checkSourceInTree(extraOption.Source, extraOption.Snapshotdir); err != nil {
+			return nil, nil, newMountError(id, daemon.ID(), MountStageExtraOption, err)
+		}
+	}
+	if o.checks.snapshotLayout {
+		if err := checkSnapshotLayout(extraOption.Snapshotdir); err != nil {
+			return nil, nil, newMountError(id, daemon.ID(), MountStageExtraOption, err)
+		}
+	}
+	if o.encoding.backendSummary {
+		extraOption.fillBackendSummary(c)
+	}
+	if o.checks.backend != nil {
+		// Don't block the mount, nor cancel the check once the mount request returns.
+		o.checks.backend.check(log.WithLogger(context.Background(), log.G(ctx)), c)
+	}
+	overlayOptions = mergeOverlayFlags(overlayOptions, o.encoding.overlayFlags)
+	// XXX: Log options without extraoptions as it might contain secrets.
+	log.G(ctx).Debugf("nydus-overlayfs mount options %v", overlayOptions)
+	if log.G(ctx).Logger.IsLevelEnabled(logrus.DebugLevel) {
+		if redacted, err := c.DumpStringRedacted(); err == nil {
+			log.G(ctx).Debugf("nydus-overlayfs daemon configuration %s", redacted)
+		}
+	}
+	if o.encoding.configByFile {
+		if extraOption.Config, err = writeExtraOptionConfigFile(extraOption.Snapshotdir, configContent); err != nil {
+			return nil, nil, newMountError(id, daemon.ID(), MountStageExtraOption, err)
+		}
+	}
+	mounts, err := buildNydusOverlayMount(extraOption, overlayOptions, o.extraOptionEncoding(instance.GetFsDriver()))
+	if err != nil {
+		if o.encoding.configByFile {
+			os.Remove(filepath.Join(extraOption.Snapshotdir, extraOptionConfigFileName))
+		}
+		return nil, nil, newMountError(id, daemon.ID(), MountStageExtraOption, err)
+	}
+	backendType, _ := c.StorageBackend()
+	collector.CollectRemoteMount(version, backendType)
+
+	return mounts, extraOption, nil
+}
+
+// Pick the daemon serving the RAFS instance, try the fallback daemons in order
+// if the primary one is gone or dead.
+func selectDaemon(ctx context.Context, primaryID string, fallbackIDs []string,
+	getDaemon func(id string) (*daemon.Daemon, error)) (*daemon.Daemon, error) {
+	d, err := getDaemon(primaryID)
+	if err == nil && daemonAvailable(d) {
+		return d, nil
+	}
+
+	for _, id := range fallbackIDs {
+		if id == primaryID {
+			continue
+		}
+		if fd, ferr := getDaemon(id); ferr == nil && daemonAvailable(fd) {
+			log.G(ctx).Warnf("daemon %s is unavailable, fail over to daemon %s", primaryID, id)
+			return fd, nil
+		}
+	}
+
+	if err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// The cached state is not refreshed when a daemon is failed over, which stays INIT
+// after it has been taken over and started, so ask nydusd before rejecting the mount.
+func daemonStarting(d *daemon.Daemon) bool {
+	if d.State() != types.DaemonStateInit {
+		return false
+	}
+	st, err := d.GetState()
+	return err != nil || st == types.DaemonStateInit
+}
+
+func daemonAvailable(d *daemon.Daemon) bool {
+	st := d.State()
+	return st != types.DaemonStateDied && st != types.DaemonStateDestroyed
+}
+
+// Load a RAFS instance configuration file of the shared daemon, ensuring it is
+// written for the same fs driver as the daemon to catch configuration drift.
+func loadInstanceConfig(fsDriver, path string) (daemonconfig.DaemonConfig, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "read configuration file %s", path)
+	}
+
+	declared, err := daemonconfig.DetectFsDriver(b)
+	if err != nil {
+		return nil, errors.Wrapf(err, "detect fs driver of configuration file %s", path)
+	}
+	if declared != fsDriver {
+		return nil, errors.Errorf("configuration file %s is for fs driver %q but daemon uses %q",
+			path, declared, fsDriver)
+	}
+
+	return daemonconfig.ParseDaemonConfig(fsDriver, b)
+}
+
+// Convert a containerd mount into an OCI runtime spec mount, for integrations injecting
+// the nydus mount into an OCI spec directly. The destination is left to the caller.
+func ToOCIMount(m mount.Mount) specs.Mount {
+	return specs.Mount{
+		Type:    m.Type,
+		Source:  m.Source,
+		Options: append([]string(nil), m.Options...),
+	}
+}
+
+func ToOCIMounts(mounts []mount.Mount) []specs.Mount {
+	ociMounts := make([]specs.Mount, 0, len(mounts))
+	for _, m := range mounts {
+		ociMounts = append(ociMounts, ToOCIMount(m))
+	}
+	return ociMounts
+}
+
+// Return a concise one-line description of a mount for events, without the
+// content of any embedded daemon configuration.
+func MountSummary(m mount.Mount) string {
+	parts := []string{"type=" + m.Type}
+	var extra *ExtraOption
+	for _, opt := range m.Options {
+		if isExtraOption(opt) {
+			if e, err := decodeExtraOption(opt); err == nil {
+				extra = e
+			}
+		}
+	}
+	parts = append(parts, fmt.Sprintf("options=%d", len(m.Options)))
+	if extra != nil {
+		parts = append(parts, extra.Summary())
+	}
+	return strings.Join(parts, " ")
+}
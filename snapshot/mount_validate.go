@@ -0,0 +1,292 @@
+/*
+ * Copyright (c) 2023. Nydus Developers. All rights reserved.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package snapshot
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+
+	"github.com/containerd/containerd/log"
+
+	"github.com/containerd/nydus-snapshotter/config"
+	"github.com/containerd/nydus-snapshotter/config/daemonconfig"
+	"github.com/containerd/nydus-snapshotter/internal/constant"
+	"github.com/containerd/nydus-snapshotter/pkg/daemon"
+	"github.com/containerd/nydus-snapshotter/pkg/errdefs"
+)
+
+// The daemon configuration of a shared daemon is not supplemented with the image's
+// registry host, repository and credentials, so it can only stand in for an instance
+// configuration of other backends. A recovered fscache daemon has no configuration.
+func checkFallbackConfig(c daemonconfig.DaemonConfig) error {
+	if c == nil {
+		return errors.New("no daemon configuration to fall back to")
+	}
+	if backendType, _ := c.StorageBackend(); backendType == "registry" {
+		return errors.New("daemon configuration lacks the image's registry repository and credentials")
+	}
+	return nil
+}
+
+// Get the blob cache directory the daemon configuration refers to.
+func cacheWorkDir(c daemonconfig.DaemonConfig) string {
+	switch cfg := c.(type) {
+	case *daemonconfig.FuseDaemonConfig:
+		if cfg.Device != nil {
+			return cfg.Device.Cache.Config.WorkDir
+		}
+	case *daemonconfig.FscacheDaemonConfig:
+		if cfg.Config != nil {
+			return cfg.Config.CacheConfig.WorkDir
+		}
+	}
+	return ""
+}
+
+// A cache directory nydusd can't write to doesn't fail the mount but silently
+// degrades the performance, so report it or create a missing one per the policy.
+func checkCacheDir(ctx context.Context, dir, policy string) error {
+	if dir == "" {
+		return nil
+	}
+
+	var err error
+	if st, e := os.Stat(dir); os.IsNotExist(e) && policy == config.CacheDirCheckCreate {
+		if e := os.MkdirAll(dir, 0755); e != nil {
+			return errors.Wrapf(e, "create cache directory %s", dir)
+		}
+		log.G(ctx).Infof("created missing cache directory %s", dir)
+	} else if e != nil {
+		err = errors.Wrapf(e, "stat cache directory")
+	} else if !st.IsDir() {
+		err = errors.Errorf("cache directory %s is not a directory", dir)
+	} else if e := unix.Access(dir, unix.W_OK); e != nil {
+		err = errors.Wrapf(e, "cache directory %s is not writable", dir)
+	}
+	if err == nil {
+		return nil
+	}
+	if policy == config.CacheDirCheckError || policy == config.CacheDirCheckCreate {
+		return err
+	}
+	log.G(ctx).Warn(err)
+
+	return nil
+}
+
+// An instance configuration file older than the daemon may be left over by a previous
+// daemon generation. It's only a hint, a restarted or failed over daemon re-attaches
+// the configuration files of its instances, which legitimately predate it.
+func checkStaleConfig(path string, daemonStartTime time.Time) error {
+	st, err := os.Stat(path)
+	if err != nil {
+		return errors.Wrapf(err, "stat configuration file %s", path)
+	}
+	if !st.ModTime().Before(daemonStartTime) {
+		return nil
+	}
+
+	return errors.Errorf("configuration file %s modified at %s predates daemon started at %s",
+		path, st.ModTime().Format(time.RFC3339), daemonStartTime.Format(time.RFC3339))
+}
+
+// The caller's overlay options must not carry an extra option already, which would
+// be duplicated in the mount and handled unpredictably by nydus-overlayfs.
+func checkNoExtraOption(overlayOptions []string) error {
+	for _, o := range overlayOptions {
+		if isExtraOption(o) || strings.HasPrefix(o, extraOptionChecksumKey) {
+			key, _, _ := strings.Cut(o, "=")
+			return errors.Wrapf(errdefs.ErrInvalidArgument, "duplicated extra option %s in mount options", key)
+		}
+	}
+	return nil
+}
+
+// Refuse to embed a runaway daemon configuration which makes the mount option unmountable.
+func checkConfigSize(configContent string, limit int) error {
+	if limit <= 0 {
+		limit = constant.DefaultMaxExtraOptionConfigSize
+	}
+	if len(configContent) > limit {
+		return errors.Errorf("daemon configuration size %d exceeds the limit %d bytes, "+
+			"please compress it or reduce its content, e.g. mirrors", len(configContent), limit)
+	}
+
+	return nil
+}
+
+// containerd mounts `fuse.<subtype>` mounts through `mount.fuse`, which runs
+// the subtype as the helper binary looked up in PATH.
+func checkOverlayFsHelper(subtype string) error {
+	if subtype == "" {
+		subtype = config.DefaultFuseSubtype
+	}
+	if _, err := exec.LookPath(subtype); err != nil {
+		return errors.Wrapf(err, "find mount helper %s", subtype)
+	}
+	return nil
+}
+
+// Check each parent layer of a multi-layer nydus mount has a bootstrap, otherwise
+// the overlay would be partially broken. The first missing layer is reported.
+func checkParentBootstraps(parentIDs []string) error {
+	for i, id := range parentIDs {
+		instance := daemon.RafsSet.Get(id)
+		if instance == nil {
+			return errors.Wrapf(errdefs.ErrNotFound, "parent layer %d snapshot %s has no rafs instance", i, id)
+		}
+		if _, err := instance.BootstrapFile(); err != nil {
+			return errors.Wrapf(err, "parent layer %d snapshot %s", i, id)
+		}
+	}
+
+	return nil
+}
+
+// Minimal nydusd version supporting each configuration schema version
+var configVersionRequirements = map[int][2]int{
+	1: {0, 0},
+	2: {2, 2},
+}
+
+// The configuration file the daemon serves the snapshot with.
+func daemonConfigFile(d *daemon.Daemon, snapshotID string) string {
+	if d.IsSharedDaemon() {
+		return d.ConfigFile(snapshotID)
+	}
+	return d.ConfigFile("")
+}
+
+// The schema version is only declared in the configuration file, the parsed
+// configuration doesn't keep it. A missing file, e.g. a shared daemon falling
+// back to its own configuration, is not checked.
+func checkConfigFileVersion(path string, d *daemon.Daemon) error {
+	b, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return errors.Wrapf(err, "read configuration file %s", path)
+	}
+	return checkConfigVersion(string(b), d)
+}
+
+// Check the schema version declared by the daemon configuration, 1 if absent,
+// is supported by the running nydusd. Unknown nydusd versions are not checked.
+func checkConfigVersion(configContent string, d *daemon.Daemon) error {
+	var declared struct {
+		Version int `json:"version"`
+	}
+	if err := json.Unmarshal([]byte(configContent), &declared); err != nil {
+		return errors.Wrapf(err, "unmarshal configuration version")
+	}
+	if declared.Version == 0 {
+		declared.Version = 1
+	}
+	required, ok := configVersionRequirements[declared.Version]
+	if !ok {
+		return errors.Errorf("unknown configuration version %d", declared.Version)
+	}
+
+	packageVer := d.DaemonVersion().PackageVer
+	major, minor, ok := parseMajorMinor(packageVer)
+	if !ok {
+		return nil
+	}
+	if major < required[0] || (major == required[0] && minor < required[1]) {
+		return errors.Errorf("configuration version %d requires nydusd v%d.%d or later, daemon %s runs %s",
+			declared.Version, required[0], required[1], d.ID(), packageVer)
+	}
+
+	return nil
+}
+
+// Parse the major and minor number of version like "v2.1.4".
+func parseMajorMinor(version string) (int, int, bool) {
+	parts := strings.SplitN(strings.TrimPrefix(version, "v"), ".", 3)
+	if len(parts) < 2 {
+		return 0, 0, false
+	}
+	major, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return 0, 0, false
+	}
+	minor, err := strconv.Atoi(parts[1])
+	if err != nil {
+		return 0, 0, false
+	}
+	return major, minor, true
+}
+
+// Check no single overlay option exceeds the limit, 0 to disable. The extra option and
+// its checksum are meant for the mount helper rather than overlayfs, so they are not
+// subject to the limit.
+func checkOptionLength(options []string, limit int) error {
+	if limit <= 0 {
+		return nil
+	}
+	for _, opt := range options {
+		if isExtraOption(opt) || strings.HasPrefix(opt, extraOptionChecksumKey) {
+			continue
+		}
+		if len(opt) > limit {
+			key, _, _ := strings.Cut(opt, "=")
+			return errors.Errorf("mount option %s is %d bytes, exceeds the limit %d bytes", key, len(opt), limit)
+		}
+	}
+
+	return nil
+}
+
+// The bootstrap must live in the same snapshots directory tree as the snapshot
+// directory, symlinks are resolved to catch any escaping.
+func checkSourceInTree(source, snapshotDir string) error {
+	root, err := filepath.EvalSymlinks(filepath.Dir(snapshotDir))
+	if err != nil {
+		return errors.Wrapf(err, "resolve snapshots directory of %s", snapshotDir)
+	}
+	dir, err := filepath.EvalSymlinks(filepath.Dir(source))
+	if err != nil {
+		return errors.Wrapf(err, "resolve directory of bootstrap %s", source)
+	}
+
+	rel, err := filepath.Rel(root, dir)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, "../") {
+		return errors.Errorf("bootstrap %s escapes snapshots directory %s", source, root)
+	}
+
+	return nil
+}
+
+// Subdirectories of an active snapshot directory the overlay mount needs
+var snapshotLayoutDirs = []string{"fs", "work"}
+
+// Check the snapshot directory has been prepared with all subdirectories
+// of the overlay mount, reporting every missing one.
+func checkSnapshotLayout(snapshotDir string) error {
+	var missing []string
+	for _, sub := range snapshotLayoutDirs {
+		info, err := os.Stat(filepath.Join(snapshotDir, sub))
+		if err != nil || !info.IsDir() {
+			missing = append(missing, sub)
+		}
+	}
+	if len(missing) > 0 {
+		return errors.Errorf("snapshot directory %s misses subdirectories %s",
+			snapshotDir, strings.Join(missing, ", "))
+	}
+
+	return nil
+}
@@ -0,0 +1,222 @@
+/*
+ * Copyright (c) 2023. Nydus Developers. All rights reserved.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package snapshot
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+
+	"github.com/containerd/containerd/snapshots"
+	"github.com/containerd/containerd/snapshots/storage"
+
+	"github.com/containerd/nydus-snapshotter/config"
+	"github.com/containerd/nydus-snapshotter/config/daemonconfig"
+	"github.com/containerd/nydus-snapshotter/internal/constant"
+	"github.com/containerd/nydus-snapshotter/pkg/daemon"
+	"github.com/containerd/nydus-snapshotter/pkg/daemon/types"
+	"github.com/containerd/nydus-snapshotter/pkg/errdefs"
+	"github.com/containerd/nydus-snapshotter/pkg/filesystem"
+)
+
+func TestCheckConfigSize(t *testing.T) {
+	require.NoError(t, checkConfigSize(fuseConfigContent, len(fuseConfigContent)))
+	require.ErrorContains(t, checkConfigSize(fuseConfigContent, len(fuseConfigContent)-1), "exceeds the limit")
+
+	// Fall back to the default limit
+	require.NoError(t, checkConfigSize(strings.Repeat("x", constant.DefaultMaxExtraOptionConfigSize), 0))
+	require.Error(t, checkConfigSize(strings.Repeat("x", constant.DefaultMaxExtraOptionConfigSize+1), 0))
+}
+
+func TestCheckSourceInTree(t *testing.T) {
+	root := t.TempDir()
+	snapshotsDir := filepath.Join(root, "snapshots")
+	bootstrapDir := filepath.Join(snapshotsDir, "1", "fs", "image")
+	require.NoError(t, os.MkdirAll(bootstrapDir, 0755))
+	require.NoError(t, os.MkdirAll(filepath.Join(snapshotsDir, "2"), 0755))
+	outside := filepath.Join(root, "outside")
+	require.NoError(t, os.MkdirAll(outside, 0755))
+
+	snapshotDir := filepath.Join(snapshotsDir, "2")
+	require.NoError(t, checkSourceInTree(filepath.Join(bootstrapDir, "image.boot"), snapshotDir))
+
+	require.Error(t, checkSourceInTree(filepath.Join(outside, "image.boot"), snapshotDir))
+	require.Error(t, checkSourceInTree(filepath.Join(snapshotsDir, "..", "outside", "image.boot"), snapshotDir))
+
+	// Escape through a symlink inside the snapshots directory
+	link := filepath.Join(snapshotsDir, "3")
+	require.NoError(t, os.Symlink(outside, link))
+	require.Error(t, checkSourceInTree(filepath.Join(link, "image.boot"), snapshotDir))
+
+	require.Error(t, checkSourceInTree(filepath.Join(snapshotsDir, "missing", "image.boot"), snapshotDir))
+}
+
+func TestCheckSnapshotLayout(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, os.Mkdir(filepath.Join(dir, "fs"), 0755))
+	require.NoError(t, os.Mkdir(filepath.Join(dir, "work"), 0711))
+	require.NoError(t, checkSnapshotLayout(dir))
+
+	malformed := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(malformed, "fs"), nil, 0644))
+	err := checkSnapshotLayout(malformed)
+	require.ErrorContains(t, err, "misses subdirectories fs, work")
+
+	require.ErrorContains(t, checkSnapshotLayout(filepath.Join(dir, "missing")), "fs, work")
+}
+
+func TestCheckStaleConfig(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.json")
+	require.NoError(t, os.WriteFile(path, []byte(fuseConfigContent), 0600))
+	st, err := os.Stat(path)
+	require.NoError(t, err)
+
+	// Config written after the daemon started
+	daemonStartTime := st.ModTime().Add(-time.Minute)
+	require.NoError(t, checkStaleConfig(path, daemonStartTime))
+
+	// Config left over by a previous daemon
+	daemonStartTime = st.ModTime().Add(time.Minute)
+	require.ErrorContains(t, checkStaleConfig(path, daemonStartTime), "predates daemon")
+
+	require.Error(t, checkStaleConfig(path+".missing", daemonStartTime))
+}
+
+func TestCheckNoExtraOption(t *testing.T) {
+	require.NoError(t, checkNoExtraOption(nil))
+	require.NoError(t, checkNoExtraOption([]string{"workdir=/work", "upperdir=/upper", "lowerdir=/lower"}))
+
+	for _, opt := range []string{"extraoption=e30=", "extraoption_json={}", "extraoption_gz=", "extraoption_checksum=00"} {
+		err := checkNoExtraOption([]string{"workdir=/work", opt})
+		require.ErrorIs(t, err, errdefs.ErrInvalidArgument, opt)
+		require.ErrorContains(t, err, "duplicated extra option", opt)
+	}
+
+	// The mount request fails at the options stage before looking up the instance.
+	o := &snapshotter{fs: &filesystem.Filesystem{}}
+	_, _, err := o.BuildRemoteMountWithOption(context.TODO(), storage.Snapshot{ID: "upper"}, "no-such-instance",
+		[]string{"workdir=/work", "extraoption=e30="})
+	var mountErr *MountError
+	require.True(t, errors.As(err, &mountErr))
+	require.Equal(t, MountStageOptions, mountErr.Stage)
+}
+
+func TestCheckOptionLength(t *testing.T) {
+	lowerdir := "lowerdir=" + strings.Repeat("l", 91)
+	options := []string{"workdir=/work", lowerdir, extraOptionKey + strings.Repeat("e", 200)}
+
+	require.NoError(t, checkOptionLength(options, 0))
+	require.NoError(t, checkOptionLength(options, len(lowerdir)))
+	require.EqualError(t, checkOptionLength(options, len(lowerdir)-1), "mount option lowerdir is 100 bytes, exceeds the limit 99 bytes")
+
+	o := &snapshotter{fs: &filesystem.Filesystem{}, checks: mountCheckOptions{maxOptionLength: len(lowerdir) - 1}}
+	s := storage.Snapshot{ID: "upper", Kind: snapshots.KindActive}
+	_, err := o.remoteMountWithExtraOptions(context.TODO(), s, "long-option", options)
+	var mountErr *MountError
+	require.True(t, errors.As(err, &mountErr))
+	require.Equal(t, MountStageOptions, mountErr.Stage)
+}
+
+func TestCheckCacheDir(t *testing.T) {
+	c, err := daemonconfig.ParseDaemonConfig(config.FsDriverFusedev, []byte(fuseConfigContent))
+	require.NoError(t, err)
+	require.Equal(t, "/var/lib/nydus/cache", cacheWorkDir(c))
+	c, err = daemonconfig.ParseDaemonConfig(config.FsDriverFscache, []byte(fscacheConfigContent))
+	require.NoError(t, err)
+	require.Equal(t, "/var/lib/nydus/fscache", cacheWorkDir(c))
+
+	writable := t.TempDir()
+	require.NoError(t, checkCacheDir(context.TODO(), writable, config.CacheDirCheckError))
+	require.NoError(t, checkCacheDir(context.TODO(), "", config.CacheDirCheckError))
+
+	missing := filepath.Join(writable, "missing")
+	require.NoError(t, checkCacheDir(context.TODO(), missing, config.CacheDirCheckWarn))
+	require.Error(t, checkCacheDir(context.TODO(), missing, config.CacheDirCheckError))
+	require.NoError(t, checkCacheDir(context.TODO(), missing, config.CacheDirCheckCreate))
+	st, err := os.Stat(missing)
+	require.NoError(t, err)
+	require.True(t, st.IsDir())
+	require.NoError(t, checkCacheDir(context.TODO(), missing, config.CacheDirCheckError))
+
+	file := filepath.Join(writable, "file")
+	require.NoError(t, os.WriteFile(file, nil, 0644))
+	require.ErrorContains(t, checkCacheDir(context.TODO(), file, config.CacheDirCheckCreate), "not a directory")
+
+	if os.Geteuid() == 0 {
+		t.Skip("root can write to read-only directories")
+	}
+	readonly := filepath.Join(writable, "readonly")
+	require.NoError(t, os.Mkdir(readonly, 0555))
+	require.NoError(t, checkCacheDir(context.TODO(), readonly, config.CacheDirCheckWarn))
+	require.ErrorContains(t, checkCacheDir(context.TODO(), readonly, config.CacheDirCheckError), "not writable")
+}
+
+func TestCheckParentBootstraps(t *testing.T) {
+	for _, id := range []string{"chain-1", "chain-2", "chain-3"} {
+		snapshotDir := t.TempDir()
+		writeV5Bootstrap(t, filepath.Join(snapshotDir, "fs", "image", "image.boot"))
+		daemon.RafsSet.Add(&daemon.Rafs{SnapshotID: id, SnapshotDir: snapshotDir})
+		defer daemon.RafsSet.Remove(id)
+	}
+	require.NoError(t, checkParentBootstraps([]string{"chain-1", "chain-2", "chain-3"}))
+
+	// Middle layer without bootstrap
+	daemon.RafsSet.Add(&daemon.Rafs{SnapshotID: "chain-2", SnapshotDir: t.TempDir()})
+	err := checkParentBootstraps([]string{"chain-1", "chain-2", "chain-3"})
+	require.ErrorContains(t, err, "parent layer 1 snapshot chain-2")
+	require.True(t, errdefs.IsNotFound(err))
+
+	// Middle layer without rafs instance
+	daemon.RafsSet.Remove("chain-2")
+	err = checkParentBootstraps([]string{"chain-1", "chain-2", "chain-3"})
+	require.ErrorContains(t, err, "parent layer 1 snapshot chain-2")
+}
+
+func TestCheckConfigVersion(t *testing.T) {
+	d := &daemon.Daemon{States: daemon.States{ID: "stub"}}
+	v2Config := `{"version": 2, "backend": {"type": "registry"}}`
+
+	// Unknown nydusd version is not checked.
+	require.NoError(t, checkConfigVersion(v2Config, d))
+
+	d.Version = types.BuildTimeInfo{PackageVer: "v2.2.1"}
+	require.NoError(t, checkConfigVersion(v2Config, d))
+	require.NoError(t, checkConfigVersion(fuseConfigContent, d))
+
+	d.Version = types.BuildTimeInfo{PackageVer: "v2.1.4"}
+	require.ErrorContains(t, checkConfigVersion(v2Config, d), "requires nydusd v2.2 or later, daemon stub runs v2.1.4")
+	require.NoError(t, checkConfigVersion(fuseConfigContent, d))
+
+	require.ErrorContains(t, checkConfigVersion(`{"version": 3}`, d), "unknown configuration version 3")
+}
+
+func TestCheckConfigFileVersion(t *testing.T) {
+	d := &daemon.Daemon{States: daemon.States{ID: "stub", ConfigDir: t.TempDir(), DaemonMode: config.DaemonModeDedicated}}
+	d.Version = types.BuildTimeInfo{PackageVer: "v2.1.4"}
+	configFile := daemonConfigFile(d, "1")
+	require.Equal(t, d.ConfigFile(""), configFile)
+
+	// The version is read from the file, the parsed configuration drops it.
+	require.NoError(t, os.WriteFile(configFile, []byte(`{"version": 2, "device": {}}`), 0600))
+	c, err := daemonconfig.NewDaemonConfig(config.FsDriverFusedev, configFile)
+	require.NoError(t, err)
+	content, err := c.DumpString()
+	require.NoError(t, err)
+	require.NotContains(t, content, "version")
+	require.ErrorContains(t, checkConfigFileVersion(configFile, d), "requires nydusd v2.2 or later")
+
+	require.NoError(t, checkConfigFileVersion(filepath.Join(t.TempDir(), "missing.json"), d))
+
+	d.States.DaemonMode = config.DaemonModeShared
+	require.Equal(t, d.ConfigFile("1"), daemonConfigFile(d, "1"))
+}
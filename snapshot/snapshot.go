@@ -9,12 +9,11 @@ package snapshot
 
 import (
 	"context"
-	"encoding/base64"
-	"encoding/json"
 	"fmt"
 	"os"
 	"path/filepath"
 	"strings"
+	"time"
 
 	"github.com/pkg/errors"
 
@@ -31,9 +30,7 @@ import (
 	"github.com/containerd/nydus-snapshotter/pkg/cache"
 	"github.com/containerd/nydus-snapshotter/pkg/cgroup"
 	v2 "github.com/containerd/nydus-snapshotter/pkg/cgroup/v2"
-	"github.com/containerd/nydus-snapshotter/pkg/daemon"
 	"github.com/containerd/nydus-snapshotter/pkg/errdefs"
-	"github.com/containerd/nydus-snapshotter/pkg/layout"
 	mgr "github.com/containerd/nydus-snapshotter/pkg/manager"
 	"github.com/containerd/nydus-snapshotter/pkg/metrics"
 	"github.com/containerd/nydus-snapshotter/pkg/metrics/collector"
@@ -50,6 +47,46 @@ import (
 )
 
 var _ snapshots.Snapshotter = &snapshotter{}
+var _ RemoteMountBuilder = &snapshotter{}
+
+// How the nydus-overlayfs mounts and the `ExtraOption` in them are encoded
+type mountEncodingOptions struct {
+	placement string
+	format    string
+	checksum  bool
+	fsVersion bool
+	header    bool
+	// `ExtraOption` fields to emit per fs driver
+	fields         map[string][]string
+	fuseSubtype    string
+	overlayFlags   []string
+	maxConfigSize  int
+	backendSummary bool
+	configByFile   bool
+	mountRetries   int
+}
+
+// Sanity checks of remote mounts before they are returned
+type mountCheckOptions struct {
+	bootstrapPath    bool
+	snapshotLayout   bool
+	parentBootstraps bool
+	staleConfig      bool
+	configVersion    bool
+	cacheDir         string
+	maxOptionLength  int
+	backend          *backendChecker
+	helperMissing    bool
+}
+
+// How remote mounts fall back or are rejected
+type mountPolicyOptions struct {
+	allowEmptyBootstrap bool
+	fallbackDaemonIDs   []string
+	fallbackFsVersion   string
+	allowedBackends     []string
+	bootstrapTimeout    time.Duration
+}
 
 type snapshotter struct {
 	root       string
@@ -61,9 +98,17 @@ type snapshotter struct {
 	enableNydusOverlayFS bool
 	syncRemove           bool
 	cleanupOnClose       bool
+	// How remote mounts are encoded, checked before returned and fall back
+	encoding           mountEncodingOptions
+	checks             mountCheckOptions
+	policy             mountPolicyOptions
+	mountPostProcessor MountPostProcessor
+	configCache        *configContentCache
 }
 
-func NewSnapshotter(ctx context.Context, cfg *config.SnapshotterConfig) (snapshots.Snapshotter, error) {
+type NewSnapshotterOpt func(s *snapshotter) error
+
+func NewSnapshotter(ctx context.Context, cfg *config.SnapshotterConfig, opt ...NewSnapshotterOpt) (snapshots.Snapshotter, error) {
 	verifier, err := signature.NewVerifier(cfg.ImageConfig.PublicKeyFile, cfg.ImageConfig.ValidateSignature)
 	if err != nil {
 		return nil, errors.Wrap(err, "initialize image verifier")
@@ -213,13 +258,32 @@ func NewSnapshotter(ctx context.Context, cfg *config.SnapshotterConfig) (snapsho
 		return nil, err
 	}
 
+	var helperMissing bool
+	if cfg.SnapshotsConfig.CheckOverlayFsHelper && cfg.SnapshotsConfig.EnableNydusOverlayFS {
+		if err := checkOverlayFsHelper(cfg.SnapshotsConfig.FuseSubtype); err != nil {
+			log.L.WithError(err).Warn("nydus-overlayfs mounts will fail on this node")
+			helperMissing = true
+		}
+	}
+
+	if cfg.SnapshotsConfig.EnableNydusOverlayFS {
+		if opts := siblingExtraOptions(&cfg.SnapshotsConfig); len(opts) > 0 {
+			log.L.Warnf("mount options %v need a nydus-overlayfs stripping them, or overlayfs rejects the mounts", opts)
+		}
+	}
+
+	var backendChecker *backendChecker
+	if cfg.SnapshotsConfig.CheckBackendReachability {
+		backendChecker = newBackendChecker(dialBackend)
+	}
+
 	syncRemove := cfg.SnapshotsConfig.SyncRemove
 	if config.GetFsDriver() == config.FsDriverFscache {
 		log.L.Infof("for fscache mode enable syncRemove")
 		syncRemove = true
 	}
 
-	return &snapshotter{
+	sn := &snapshotter{
 		root:                 cfg.Root,
 		nydusdPath:           cfg.DaemonConfig.NydusdPath,
 		ms:                   ms,
@@ -228,7 +292,48 @@ func NewSnapshotter(ctx context.Context, cfg *config.SnapshotterConfig) (snapsho
 		manager:              manager,
 		enableNydusOverlayFS: cfg.SnapshotsConfig.EnableNydusOverlayFS,
 		cleanupOnClose:       cfg.CleanupOnClose,
-	}, nil
+		encoding: mountEncodingOptions{
+			placement:      cfg.SnapshotsConfig.ExtraOptionPlacement,
+			format:         cfg.SnapshotsConfig.ExtraOptionFormat,
+			checksum:       cfg.SnapshotsConfig.EmitExtraOptionChecksum,
+			fsVersion:      cfg.SnapshotsConfig.EmitFsVersionOption,
+			header:         cfg.SnapshotsConfig.EmitExtraOptionHeader,
+			fields:         cfg.SnapshotsConfig.ExtraOptionFields,
+			fuseSubtype:    cfg.SnapshotsConfig.FuseSubtype,
+			overlayFlags:   cfg.SnapshotsConfig.OverlayFlags,
+			maxConfigSize:  cfg.SnapshotsConfig.MaxExtraOptionConfigSize,
+			backendSummary: cfg.SnapshotsConfig.ExposeBackendSummary,
+			configByFile:   cfg.SnapshotsConfig.ExtraOptionConfigFile,
+			mountRetries:   cfg.SnapshotsConfig.MountRetries,
+		},
+		checks: mountCheckOptions{
+			bootstrapPath:    cfg.SnapshotsConfig.ValidateBootstrapPath,
+			snapshotLayout:   cfg.SnapshotsConfig.ValidateSnapshotLayout,
+			parentBootstraps: cfg.SnapshotsConfig.StrictParentBootstraps,
+			staleConfig:      cfg.SnapshotsConfig.WarnStaleConfig,
+			configVersion:    cfg.SnapshotsConfig.CheckConfigVersion,
+			cacheDir:         cfg.SnapshotsConfig.CacheDirCheck,
+			maxOptionLength:  cfg.SnapshotsConfig.MaxMountOptionLength,
+			backend:          backendChecker,
+			helperMissing:    helperMissing,
+		},
+		policy: mountPolicyOptions{
+			allowEmptyBootstrap: cfg.SnapshotsConfig.AllowEmptyBootstrap,
+			fallbackDaemonIDs:   cfg.SnapshotsConfig.FallbackDaemonIDs,
+			fallbackFsVersion:   cfg.SnapshotsConfig.FallbackFsVersion,
+			allowedBackends:     cfg.SnapshotsConfig.AllowedBackends,
+			bootstrapTimeout:    time.Duration(cfg.SnapshotsConfig.BootstrapReadTimeoutSecs) * time.Second,
+		},
+		configCache: newConfigContentCache(),
+	}
+
+	for _, o := range opt {
+		if err := o(sn); err != nil {
+			return nil, err
+		}
+	}
+
+	return sn, nil
 }
 
 func (o *snapshotter) Cleanup(ctx context.Context) error {
@@ -762,82 +867,6 @@ func (o *snapshotter) remoteMounts(ctx context.Context, s storage.Snapshot, id s
 	return overlayMount(overlayOptions), nil
 }
 
-type ExtraOption struct {
-	Source      string `json:"source"`
-	Config      string `json:"config"`
-	Snapshotdir string `json:"snapshotdir"`
-	Version     string `json:"fs_version"`
-}
-
-func (o *snapshotter) remoteMountWithExtraOptions(ctx context.Context, s storage.Snapshot, id string, overlayOptions []string) ([]mount.Mount, error) {
-	source, err := o.fs.BootstrapFile(id)
-	if err != nil {
-		return nil, err
-	}
-
-	instance := daemon.RafsSet.Get(id)
-	daemon, err := o.fs.GetDaemonByID(instance.DaemonID)
-	if err != nil {
-		return nil, errors.Wrapf(err, "get daemon with ID %s", instance.DaemonID)
-	}
-
-	var c daemonconfig.DaemonConfig
-	if daemon.IsSharedDaemon() {
-		c, err = daemonconfig.NewDaemonConfig(daemon.States.FsDriver, daemon.ConfigFile(instance.SnapshotID))
-		if err != nil {
-			return nil, errors.Wrapf(err, "Failed to load instance configuration %s",
-				daemon.ConfigFile(instance.SnapshotID))
-		}
-	} else {
-		c = daemon.Config
-	}
-	configContent, err := c.DumpString()
-	if err != nil {
-		return nil, errors.Wrapf(err, "remoteMounts: failed to marshal config")
-	}
-
-	// get version from bootstrap
-	f, err := os.Open(source)
-	if err != nil {
-		return nil, errors.Wrapf(err, "remoteMounts: check bootstrap version: failed to open bootstrap")
-	}
-	defer f.Close()
-	header := make([]byte, 4096)
-	sz, err := f.Read(header)
-	if err != nil {
-		return nil, errors.Wrapf(err, "remoteMounts: check bootstrap version: failed to read bootstrap")
-	}
-	version, err := layout.DetectFsVersion(header[0:sz])
-	if err != nil {
-		return nil, errors.Wrapf(err, "remoteMounts: failed to detect filesystem version")
-	}
-
-	// when enable nydus-overlayfs, return unified mount slice for runc and kata
-	extraOption := &ExtraOption{
-		Source:      source,
-		Config:      configContent,
-		Snapshotdir: o.snapshotDir(s.ID),
-		Version:     version,
-	}
-	no, err := json.Marshal(extraOption)
-	if err != nil {
-		return nil, errors.Wrapf(err, "remoteMounts: failed to marshal NydusOption")
-	}
-	// XXX: Log options without extraoptions as it might contain secrets.
-	log.G(ctx).Debugf("fuse.nydus-overlayfs mount options %v", overlayOptions)
-	// base64 to filter easily in `nydus-overlayfs`
-	opt := fmt.Sprintf("extraoption=%s", base64.StdEncoding.EncodeToString(no))
-	overlayOptions = append(overlayOptions, opt)
-
-	return []mount.Mount{
-		{
-			Type:    "fuse.nydus-overlayfs",
-			Source:  "overlay",
-			Options: overlayOptions,
-		},
-	}, nil
-}
-
 func (o *snapshotter) mounts(ctx context.Context, labels map[string]string, s storage.Snapshot) ([]mount.Mount, error) {
 	if len(s.ParentIDs) == 0 {
 		// if we only have one layer/no parents then just return a bind mount as overlay will not work
@@ -948,6 +977,7 @@ func (o *snapshotter) cleanupSnapshotDirectory(ctx context.Context, dir string)
 	if err := o.fs.Umount(ctx, snapshotID); err != nil && !os.IsNotExist(err) {
 		log.G(ctx).WithError(err).WithField("dir", dir).Error("failed to unmount")
 	}
+	o.configCache.remove(snapshotID)
 
 	if err := os.RemoveAll(dir); err != nil {
 		return errors.Wrapf(err, "remove directory %q", dir)